@@ -0,0 +1,101 @@
+package client
+
+import (
+	"aRPC/edcode"
+	"aRPC/rpcserver"
+	"context"
+	"errors"
+)
+
+// BatchCall 批量调用中的一个调用，Do 返回后 Reply 和 Error 是这个调用的结果
+type BatchCall struct {
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+	Error         error
+}
+
+// Batch 收集多个调用，用一个请求发给服务端，服务端全部执行完后用一个回复返回所有的结果。
+// 每个参数和回复用连接协商的编解码方式单独编码，protobuf 连接不支持批量调用，见 ErrBatchUnsupported
+type Batch struct {
+	Sequential bool // 服务端按添加的顺序逐个执行，默认并发执行
+
+	client *Client
+	calls  []*BatchCall
+}
+
+// Batch 创建一个空的批量调用
+func (client *Client) Batch() *Batch {
+	return &Batch{client: client}
+}
+
+// Add 添加一个调用，reply 为 nil 时丢弃回复
+func (b *Batch) Add(serviceMethod string, args, reply interface{}) *BatchCall {
+	call := &BatchCall{ServiceMethod: serviceMethod, Args: args, Reply: reply}
+	b.calls = append(b.calls, call)
+	return call
+}
+
+var (
+	// ErrBatchUnsupported 连接协商的编解码方式不能承载批量调用，目前是 protobuf
+	ErrBatchUnsupported = errors.New("rpc client: batch is not supported by the codec")
+	// ErrBatchEmpty 没有可以发送的调用，或者每个调用的参数都编码失败
+	ErrBatchEmpty   = errors.New("rpc client: no call to send in the batch")
+	errBatchResults = errors.New("rpc client: wrong number of batch results")
+)
+
+// Do 发送所有的调用并等待回复，ctx 的作用和 Call 相同，不经过拦截器。
+// 返回的错误说明整个批量调用失败，此时每个调用的 Error 也是这个错误；
+// 否则每个调用的错误在各自的 Error 中。参数和回复按添加的顺序共用一个编码器和解码器。
+// protobuf 连接返回 ErrBatchUnsupported，没有一个调用可以发送时返回 ErrBatchEmpty
+func (b *Batch) Do(ctx context.Context) error {
+	if b.client.opt.CodeType == edcode.ProtobufType {
+		for _, call := range b.calls {
+			call.Error = ErrBatchUnsupported
+		}
+		return ErrBatchUnsupported
+	}
+	enc, err := edcode.NewBodyEncoder(b.client.opt.CodeType)
+	if err != nil {
+		return err
+	}
+	dec, err := edcode.NewBodyDecoder(b.client.opt.CodeType)
+	if err != nil {
+		return err
+	}
+	req := &rpcserver.BatchRequest{Sequential: b.Sequential}
+	sent := make([]*BatchCall, 0, len(b.calls))
+	for _, call := range b.calls {
+		args, err := enc.Encode(call.Args)
+		call.Error = err
+		if err != nil {
+			continue
+		}
+		req.Entries = append(req.Entries, rpcserver.BatchEntry{ServiceMethod: call.ServiceMethod, Args: args})
+		sent = append(sent, call)
+	}
+	if len(sent) == 0 {
+		return ErrBatchEmpty
+	}
+	var reply rpcserver.BatchReply
+	err = b.client.do(ctx, &Call{Args: req, Reply: &reply, batch: true})
+	if err == nil && len(reply.Results) != len(sent) {
+		err = errBatchResults
+	}
+	if err != nil {
+		for _, call := range sent {
+			call.Error = err
+		}
+		return err
+	}
+	//出错的调用没有回复，其余的回复按顺序解码，reply 为 nil 的也要解码
+	for i, result := range reply.Results {
+		call := sent[i]
+		if result.Error != "" {
+			call.Error = serverError(result.Error)
+			continue
+		}
+		call.Error = dec.Decode(result.Reply, call.Reply)
+	}
+	return nil
+}
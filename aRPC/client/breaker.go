@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState 熔断器的状态
+type BreakerState int
+
+const (
+	StateClosed   BreakerState = iota // 正常调用，统计错误率
+	StateOpen                         // 直接返回 BreakerOpenError
+	StateHalfOpen                     // 放行少量探测调用，全部成功后关闭，任意一个失败重新打开
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("breaker state %d", int(s))
+	}
+}
+
+// BreakerOption 熔断器的参数
+type BreakerOption struct {
+	Window         time.Duration        // 统计错误率的时间窗口，每个窗口重新计数，负数表示不分窗口
+	MinRequests    int                  // 窗口内的调用数达到这个值才会打开
+	ErrorRatio     float64              // 失败的比例达到这个值时打开
+	SlowThreshold  time.Duration        // 耗时超过这个值的调用也算失败，0 表示不统计耗时
+	OpenTimeout    time.Duration        // 打开后经过这段时间进入半开状态
+	HalfOpenProbes int                  // 半开状态放行的探测调用数
+	IsFailure      func(err error) bool // 哪些错误算失败，nil 时所有的错误都算
+}
+
+var DefaultBreakerOption = &BreakerOption{
+	Window:         10 * time.Second,
+	MinRequests:    10,
+	ErrorRatio:     0.5,
+	OpenTimeout:    5 * time.Second,
+	HalfOpenProbes: 1,
+}
+
+// ErrBreakerOpen 熔断器打开时调用直接失败，没有发给服务端
+var ErrBreakerOpen = errors.New("rpc client: circuit breaker is open")
+
+// BreakerOpenError ServiceMethod 为空表示整个地址的熔断器打开了
+type BreakerOpenError struct {
+	Addr          string
+	ServiceMethod string
+}
+
+func (e *BreakerOpenError) Error() string {
+	if e.ServiceMethod == "" {
+		return fmt.Sprintf("%s: %s", ErrBreakerOpen, e.Addr)
+	}
+	return fmt.Sprintf("%s: %s %s", ErrBreakerOpen, e.Addr, e.ServiceMethod)
+}
+
+func (e *BreakerOpenError) Unwrap() error {
+	return ErrBreakerOpen
+}
+
+type breaker struct {
+	opt *BreakerOption
+
+	mu         sync.Mutex
+	state      BreakerState
+	generation uint64    // 每次状态变化加一，丢弃之前状态下发出的调用的结果
+	expiry     time.Time // closed: 当前窗口结束的时间；open: 进入半开的时间
+	requests   int
+	failures   int
+	probes     int // 半开状态已经放行的探测调用
+	successes  int // 半开状态成功的探测调用
+}
+
+func (b *breaker) currentState(now time.Time) BreakerState {
+	switch {
+	case b.state == StateClosed && !b.expiry.IsZero() && now.After(b.expiry):
+		b.setState(StateClosed, now)
+	case b.state == StateOpen && now.After(b.expiry):
+		b.setState(StateHalfOpen, now)
+	}
+	return b.state
+}
+
+func (b *breaker) setState(state BreakerState, now time.Time) {
+	b.state = state
+	b.generation++
+	b.requests, b.failures, b.probes, b.successes = 0, 0, 0, 0
+	switch state {
+	case StateClosed:
+		b.expiry = time.Time{}
+		if b.opt.Window > 0 {
+			b.expiry = now.Add(b.opt.Window)
+		}
+	case StateOpen:
+		b.expiry = now.Add(b.opt.OpenTimeout)
+	default:
+		b.expiry = time.Time{}
+	}
+}
+
+// allow 返回调用所在的 generation，熔断器打开或者半开状态的探测调用用完时返回 false
+func (b *breaker) allow(now time.Time) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState(now) {
+	case StateOpen:
+		return 0, false
+	case StateHalfOpen:
+		if b.probes >= b.opt.HalfOpenProbes {
+			return 0, false
+		}
+		b.probes++
+	}
+	return b.generation, true
+}
+
+// release 放弃 allow 放行的调用，把探测的名额还回去
+func (b *breaker) release(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation == b.generation && b.state == StateHalfOpen {
+		b.probes--
+	}
+}
+
+func (b *breaker) record(generation uint64, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation || b.currentState(now) == StateOpen {
+		return
+	}
+	if b.state == StateHalfOpen {
+		if failed {
+			b.setState(StateOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.opt.HalfOpenProbes {
+			b.setState(StateClosed, now)
+		}
+		return
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.failures > 0 && b.requests >= b.opt.MinRequests && float64(b.failures) >= b.opt.ErrorRatio*float64(b.requests) {
+		b.setState(StateOpen, now)
+	}
+}
+
+// Breakers 按 protocol@addr 和 protocol@addr 上的每个 ServiceMethod 分别熔断，
+// 两个熔断器都放行时才会调用
+type Breakers struct {
+	opt BreakerOption
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// NewBreakers opt 为 nil 时使用 DefaultBreakerOption，opt 中为 0 的参数也使用 DefaultBreakerOption 的值
+func NewBreakers(opt *BreakerOption) *Breakers {
+	if opt == nil {
+		opt = DefaultBreakerOption
+	}
+	bs := &Breakers{opt: *opt, breakers: make(map[string]*breaker)}
+	if bs.opt.Window == 0 {
+		bs.opt.Window = DefaultBreakerOption.Window
+	}
+	if bs.opt.MinRequests < 1 {
+		bs.opt.MinRequests = DefaultBreakerOption.MinRequests
+	}
+	if bs.opt.ErrorRatio <= 0 {
+		bs.opt.ErrorRatio = DefaultBreakerOption.ErrorRatio
+	}
+	if bs.opt.OpenTimeout <= 0 {
+		bs.opt.OpenTimeout = DefaultBreakerOption.OpenTimeout
+	}
+	if bs.opt.HalfOpenProbes < 1 {
+		bs.opt.HalfOpenProbes = DefaultBreakerOption.HalfOpenProbes
+	}
+	return bs
+}
+
+func (bs *Breakers) get(addr, serviceMethod string) *breaker {
+	key := addr
+	if serviceMethod != "" {
+		key = addr + " " + serviceMethod
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.breakers[key]
+	if b == nil {
+		b = &breaker{opt: &bs.opt}
+		b.setState(StateClosed, time.Now())
+		bs.breakers[key] = b
+	}
+	return b
+}
+
+// State 返回熔断器当前的状态，serviceMethod 为空时返回整个地址的熔断器的状态
+func (bs *Breakers) State(addr, serviceMethod string) BreakerState {
+	b := bs.get(addr, serviceMethod)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState(time.Now())
+}
+
+// Allow 两个熔断器都放行时返回 done，调用结束后必须用调用的结果调用 done；
+// 否则返回 *BreakerOpenError
+func (bs *Breakers) Allow(addr, serviceMethod string) (done func(err error), err error) {
+	ab, mb := bs.get(addr, ""), bs.get(addr, serviceMethod)
+	start := time.Now()
+	ag, ok := ab.allow(start)
+	if !ok {
+		return nil, &BreakerOpenError{Addr: addr}
+	}
+	mg, ok := mb.allow(start)
+	if !ok {
+		ab.release(ag)
+		return nil, &BreakerOpenError{Addr: addr, ServiceMethod: serviceMethod}
+	}
+	return func(err error) {
+		now := time.Now()
+		failed := err != nil && (bs.opt.IsFailure == nil || bs.opt.IsFailure(err))
+		if bs.opt.SlowThreshold > 0 && now.Sub(start) > bs.opt.SlowThreshold {
+			failed = true
+		}
+		ab.record(ag, failed, now)
+		mb.record(mg, failed, now)
+	}, nil
+}
+
+// BreakerClient 经过熔断器调用 addr 上的 caller，熔断器打开时直接返回 *BreakerOpenError
+type BreakerClient struct {
+	addr     string
+	caller   Caller
+	breakers *Breakers
+}
+
+// NewBreakerClient addr 是 caller 连接的地址，格式与 XDial 相同；
+// 多个客户端可以共用一个 Breakers
+func NewBreakerClient(addr string, caller Caller, breakers *Breakers) *BreakerClient {
+	return &BreakerClient{addr: addr, caller: caller, breakers: breakers}
+}
+
+func (bc *BreakerClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	done, err := bc.breakers.Allow(bc.addr, serviceMethod)
+	if err != nil {
+		return err
+	}
+	err = bc.caller.Call(ctx, serviceMethod, args, reply)
+	done(err)
+	return err
+}
+
+// Go 异步调用 Call，熔断器打开时 call.Error 为 *BreakerOpenError，完成后通知 call.Done
+func (bc *BreakerClient) Go(serviceMethod string, args, reply interface{}, ch chan *Call) *Call {
+	return goCaller(bc, serviceMethod, args, reply, ch)
+}
+
+// IsIdempotent 用 RetryClient 包装 BreakerClient 时，服务端声明的幂等方法也会重试
+func (bc *BreakerClient) IsIdempotent(serviceMethod string) bool {
+	checker, ok := bc.caller.(IdempotentChecker)
+	return ok && checker.IsIdempotent(serviceMethod)
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,6 +23,15 @@ type Call struct {
 	Reply        interface{}
 	Error        error
 	Done         chan *Call //是否已经完成
+
+	Metadata      map[string]string //随请求发送的元数据
+	ReplyMetadata map[string]string //服务端随响应返回的元数据
+
+	timeout   time.Duration //由 ctx 的 deadline 得出，随 header 发给服务端
+	window    uint32        //流式调用的初始接收窗口
+	endStream bool          //服务端流式调用的请求带着全部的参数
+	batch     bool          //批量调用，Args 和 Reply 为 rpcserver.BatchRequest 和 rpcserver.BatchReply
+	stream    *clientStream //流式调用的两端，流帧交给它，结束帧完成 call
 }
 
 // 将完成的call塞入管道
@@ -41,6 +51,13 @@ type Client struct {
 
 	closing  bool //正常关闭
 	shutdown bool //异常关闭
+	goaway   bool //服务端正在关闭，不再发送新的请求
+
+	interceptors []Interceptor
+	idempotent   map[string]bool //服务端在握手时声明的幂等方法，创建后不再修改
+
+	unavailable     chan struct{} //不能再发送新的请求时关闭
+	unavailableOnce sync.Once
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -60,17 +77,46 @@ func (client *Client) Close() error {
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.goaway
+}
+
+// IsGoingAway 收到了服务端的 GOAWAY，连接不可用，但是已经发出的请求还在等待回复，
+// 不要关闭它，服务端回复完之后会关闭连接
+func (client *Client) IsGoingAway() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.goaway && !client.shutdown && !client.closing
+}
+
+// IsIdempotent 服务端是否在握手时声明了 serviceMethod 是幂等的
+func (client *Client) IsIdempotent(serviceMethod string) bool {
+	return client.idempotent[serviceMethod]
+}
+
+// NumPending return the number of calls still waiting for a response
+func (client *Client) NumPending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
 }
 
 var ErrShutdown = errors.New("connection is shut down")
 
+// ErrConnectTimeout 在 ConnectTimeout 内没有完成连接和握手
+var ErrConnectTimeout = errors.New("rpc client: connect timeout")
+
+// ErrGoAway 服务端正在关闭，请求没有发出或者没有被服务端接受，可以换一个连接重试
+var ErrGoAway = errors.New("rpc client: server is going away")
+
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	if client.closing || client.shutdown {
 		return 0, ErrShutdown
 	}
+	if client.goaway {
+		return 0, ErrGoAway
+	}
 	call.Seq = client.seq
 	client.pending[call.Seq] = call
 	client.seq++ //注册一个分配一个seq，从0开始分配
@@ -90,12 +136,17 @@ func (client *Client) terminateCalls(err error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	client.shutdown = true
+	client.markUnavailable()
 	for _, call := range client.pending {
 		call.Error = err
 		call.done()
 	}
 }
 
+func (client *Client) markUnavailable() {
+	client.unavailableOnce.Do(func() { close(client.unavailable) })
+}
+
 // 在客户端一启动就会持续监听服务端发过来的请求，发生错误就会终止并报告错误
 // 只有一个读口，不需要加锁
 func (client *Client) receive() {
@@ -108,13 +159,27 @@ func (client *Client) receive() {
 			fmt.Println("Err:", err)
 			break
 		}
+		//服务端正在关闭，h.Seq 是服务端接受的最后一个请求，之前的请求仍然会收到回复
+		if h.GoAway {
+			client.goAway(h.Seq)
+			err = client.c.ReadBody(nil)
+			continue
+		}
+		//流的数据帧，流还没有结束，不能移除 call
+		if h.Stream {
+			err = client.deliverStream(&h)
+			continue
+		}
 		//client 里面的序列号是用来分配的
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.ReplyMetadata = h.Metadata
+		}
 		switch {
 		case call == nil:
 			err = client.c.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = serverError(h.Error)
 			_ = client.c.ReadBody(nil)
 			call.done()
 		default:
@@ -122,6 +187,9 @@ func (client *Client) receive() {
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
 			}
+			if errors.Is(err, edcode.ErrBodyType) {
+				err = nil // the body has been consumed, keep the connection
+			}
 			call.done()
 		}
 	}
@@ -129,7 +197,66 @@ func (client *Client) receive() {
 	client.terminateCalls(err)
 }
 
-// NewClient 在新建客户端的时候就启动了receive
+// goAway 不再发送新的请求，服务端没有接受的请求以 ErrGoAway 结束
+func (client *Client) goAway(lastSeq uint64) {
+	client.mu.Lock()
+	client.goaway = true
+	client.markUnavailable()
+	var rejected []*Call
+	for seq, call := range client.pending {
+		if seq > lastSeq {
+			delete(client.pending, seq)
+			rejected = append(rejected, call)
+		}
+	}
+	client.mu.Unlock()
+	for _, call := range rejected {
+		call.Error = ErrGoAway
+		call.done()
+	}
+}
+
+// PanicError 服务方法在服务端发生了 panic，Message 是服务端回复的错误信息。
+// errors.Is(err, rpcserver.ErrServicePanic) 也可以判断这种错误
+type PanicError struct {
+	Message string
+}
+
+func (e *PanicError) Error() string {
+	return e.Message
+}
+
+func (e *PanicError) Unwrap() error {
+	return rpcserver.ErrServicePanic
+}
+
+// RetryableError 服务方法返回了 rpcserver.Retryable 包装的错误，
+// errors.Is(err, rpcserver.ErrRetryable) 也可以判断这种错误
+type RetryableError struct {
+	Message string
+}
+
+func (e *RetryableError) Error() string {
+	return e.Message
+}
+
+func (e *RetryableError) Unwrap() error {
+	return rpcserver.ErrRetryable
+}
+
+// 把服务端回复的错误信息转换成 error
+func serverError(msg string) error {
+	switch {
+	case strings.HasPrefix(msg, rpcserver.ErrServicePanic.Error()):
+		return &PanicError{Message: msg}
+	case strings.HasPrefix(msg, rpcserver.ErrRetryable.Error()):
+		return &RetryableError{Message: msg}
+	}
+	return errors.New(msg)
+}
+
+// NewClient 在新建客户端的时候就启动了receive。
+// option.Version 为 0 时不等待握手应答，只有这样才能连接不支持握手的旧服务端
 func NewClient(conn net.Conn, option *rpcserver.Option) (*Client, error) {
 	f := edcode.NewCodecFuncMap[option.CodeType]
 	if f == nil {
@@ -142,20 +269,106 @@ func NewClient(conn net.Conn, option *rpcserver.Option) (*Client, error) {
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), option), nil
+	accepted, idempotent, err := handshake(conn, option)
+	if err != nil {
+		log.Println("rpc client: handshake error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	f = edcode.NewCodecFuncMap[accepted.CodeType]
+	if f == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("invalid codec type %s", accepted.CodeType)
+	}
+	c, err := edcode.WithCompression(f(conn), accepted.CodeType, accepted.Compression, accepted.CompressThreshold)
+	if err != nil {
+		log.Println("rpc client: compression error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	client := newClientCodec(c, accepted)
+	for _, method := range idempotent {
+		if client.idempotent == nil {
+			client.idempotent = make(map[string]bool)
+		}
+		client.idempotent[method] = true
+	}
+	return client, nil
+}
+
+// HandshakeError 服务端拒绝了客户端的 Option，Code 说明了拒绝的原因
+type HandshakeError struct {
+	Code          rpcserver.RejectCode
+	Message       string
+	ServerVersion int // 服务端支持的最高协议版本
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("rpc client: handshake rejected (%s): %s", e.Code, e.Message)
+}
+
+// handshakeTimeout ConnectTimeout 为 0 时等待握手应答的时间，不认识握手的旧服务端不会应答
+var handshakeTimeout = 10 * time.Second
+
+// 等待服务端的握手应答，返回服务端接受的 Option 和服务端声明的幂等方法。
+// Version 为 0 时按旧协议处理，服务端不会应答
+func handshake(conn net.Conn, option *rpcserver.Option) (*rpcserver.Option, []string, error) {
+	if option.Version == 0 {
+		return option, nil, nil
+	}
+	timeout := option.ConnectTimeout
+	if timeout == 0 {
+		timeout = handshakeTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	//服务端在收到第一个请求之前只会写应答，json 解码器不会多读后面的报文
+	var ack rpcserver.HandshakeAck
+	if err := json.NewDecoder(conn).Decode(&ack); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, nil, fmt.Errorf("%w: no handshake ack within %s, the server may not support the handshake",
+				ErrConnectTimeout, timeout)
+		}
+		return nil, nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	if !ack.Accepted {
+		return nil, nil, &HandshakeError{Code: ack.Code, Message: ack.Message, ServerVersion: ack.Version}
+	}
+	if ack.Option.Version < rpcserver.MinProtocolVersion || ack.Option.Version > option.Version {
+		return nil, nil, &HandshakeError{
+			Code:          rpcserver.RejectUnsupportedVersion,
+			Message:       fmt.Sprintf("server accepted unsupported protocol version %d", ack.Option.Version),
+			ServerVersion: ack.Version,
+		}
+	}
+	//服务端的选项只影响协议本身，超时等本地设置保留客户端的值
+	accepted := *option
+	accepted.Version = ack.Option.Version
+	accepted.CodeType = ack.Option.CodeType
+	accepted.Compression = ack.Option.Compression
+	accepted.CompressThreshold = ack.Option.CompressThreshold
+	accepted.StreamWindow = ack.Option.StreamWindow
+	return &accepted, ack.Idempotent, nil
 }
 func newClientCodec(codec edcode.Codec, option *rpcserver.Option) *Client {
 	client := &Client{
-		seq:     1, // seq starts with 1, 0 means invalid call
-		c:       codec,
-		opt:     option,
-		pending: make(map[uint64]*Call),
+		seq:         1, // seq starts with 1, 0 means invalid call
+		c:           codec,
+		opt:         option,
+		pending:     make(map[uint64]*Call),
+		unavailable: make(chan struct{}),
 	}
 	go client.receive()
 	return client
 }
 
-// 可变参数，1或者0
+// 可变参数，1或者0。Version 为 0 时使用 ProtocolVersion，
+// 所以 Dial、XDial 和建立在它们之上的客户端都要求服务端支持握手，旧服务端需要直接用 NewClient 连接
 func parseOptions(opts ...*rpcserver.Option) (*rpcserver.Option, error) {
 	if len(opts) == 0 || opts[0] == nil {
 		return rpcserver.DefaultOption, nil
@@ -163,12 +376,16 @@ func parseOptions(opts ...*rpcserver.Option) (*rpcserver.Option, error) {
 	if len(opts) != 1 {
 		return nil, errors.New("number of options is more than 1")
 	}
-	opt := opts[0]
+	//复制一份，同一个 Option 可能被多个连接同时使用
+	opt := *opts[0]
 	opt.MagicInt = rpcserver.MagicData
+	if opt.Version == 0 {
+		opt.Version = rpcserver.ProtocolVersion
+	}
 	if opt.CodeType == "" {
 		opt.CodeType = rpcserver.DefaultOption.CodeType
 	}
-	return opt, nil
+	return &opt, nil
 }
 
 type clientResult struct {
@@ -205,7 +422,7 @@ func dialTimeout(f NewClientFunc, network, addr string, opts ...*rpcserver.Optio
 	case ret := <-ch:
 		return ret.client, ret.err
 	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+		return nil, fmt.Errorf("%w: expect within %s", ErrConnectTimeout, opt.ConnectTimeout)
 	}
 }
 func Dial(network, address string, opts ...*rpcserver.Option) (*Client, error) {
@@ -218,12 +435,18 @@ func (client *Client) send(call *Call) {
 	seq, err := client.registerCall(call)
 	if err != nil {
 		call.Error = err
+		call.done()
 		return
 	}
 
 	//发送头
 	client.header.Seq = seq
 	client.header.ServiceMethod = call.ServerMethod
+	client.header.Timeout = call.timeout
+	client.header.Metadata = call.Metadata
+	client.header.Window = call.window
+	client.header.EndStream = call.endStream
+	client.header.Batch = call.batch
 	//消息体：call.Args
 	if err := client.c.WriteHeaderAndBody(&client.header, call.Args); err != nil {
 		call := client.removeCall(seq)
@@ -234,19 +457,59 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// 通知服务端取消 seq 对应的请求，服务端不会为取消帧单独回复
+func (client *Client) sendCancel(seq uint64, serviceMethod string) {
+	client.sendControl(&edcode.Header{ServiceMethod: serviceMethod, Seq: seq, Cancel: true})
+}
+
+// sendControl 发送取消、窗口更新等 body 为空的控制帧
+func (client *Client) sendControl(h *edcode.Header) {
+	if err := client.writeFrame(h, invalidRequest); err != nil {
+		log.Println("rpc client: send control frame error:", err)
+	}
+}
+
+// writeFrame 发送不属于新请求的帧
+func (client *Client) writeFrame(h *edcode.Header, body interface{}) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	return client.c.WriteHeaderAndBody(h, body)
+}
+
+// invalidRequest is a placeholder for cancel body
+var invalidRequest = struct{}{}
+
 // Go 需要新建一个call，并发送出去
+// 添加了拦截器时，请求会在拦截器链执行完之后才发送，Seq 不再有意义
 func (client *Client) Go(MethodName string, args, reply interface{}, ch chan *Call) *Call {
-	if ch == nil {
-		ch = make(chan *Call, 10)
-	} else if cap(ch) == 0 {
-		log.Panic("rpc client: done channel is unbuffered")
-	}
 	call := &Call{
 		ServerMethod: MethodName,
 		Args:         args,
 		Reply:        reply,
-		Done:         ch,
 	}
+	client.mu.Lock()
+	interceptors := client.interceptors
+	client.mu.Unlock()
+	if len(interceptors) == 0 {
+		return client.goCall(call, ch)
+	}
+	call.Done = doneChan(ch)
+	client.goIntercepted(interceptors, call)
+	return call
+}
+
+func doneChan(ch chan *Call) chan *Call {
+	if ch == nil {
+		ch = make(chan *Call, 10)
+	} else if cap(ch) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
+	}
+	return ch
+}
+
+// goCall 发送一个已经填好请求信息的 call，Metadata 和 timeout 由调用方设置
+func (client *Client) goCall(call *Call, ch chan *Call) *Call {
+	call.Done = doneChan(ch)
 	//client.Go() 函数里的 client.send() ，
 	//是否应该为 go client.send() ？
 	//我认为返回 call 不需要等待 client.send() 执行完。
@@ -258,14 +521,62 @@ func (client *Client) Go(MethodName string, args, reply interface{}, ch chan *Ca
 // 异步请求确实有很多种其他的方式，
 // 但是 client.Go 的好处在于参数 ch chan *Call 可以自定义缓冲区的大小，
 // 可以给多个 client.Go 传入同一个 chan 对象，从而控制异步请求并发的数量。
+// ctx 的 deadline 和元数据会随请求发给服务端，ctx 结束时通知服务端取消该请求。
+// 添加了拦截器时先经过拦截器链
 func (client *Client) Call(ctx context.Context, MethodName string, args, reply interface{}) error {
-	call := client.Go(MethodName, args, reply, make(chan *Call, 1))
+	client.mu.Lock()
+	interceptors := client.interceptors
+	client.mu.Unlock()
+	return chain(interceptors, client.call)(ctx, MethodName, args, reply)
+}
+
+// Notify 发送单向请求，服务端执行 serviceMethod 后不回复，出错也不回复。
+// 请求写入连接后就返回，不经过拦截器，也不知道服务端是否执行成功
+func (client *Client) Notify(serviceMethod string, args interface{}) error {
+	//和 send 一样在 sending 中分配 seq，请求按 seq 的顺序写入连接
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		return ErrShutdown
+	}
+	if client.goaway {
+		client.mu.Unlock()
+		return ErrGoAway
+	}
+	//不注册 call，只占用一个 seq，服务端仍然按 seq 区分正在处理的请求
+	seq := client.seq
+	client.seq++
+	client.mu.Unlock()
+	return client.c.WriteHeaderAndBody(&edcode.Header{ServiceMethod: serviceMethod, Seq: seq, OneWay: true}, args)
+}
+
+// call 是拦截器链的最后一环
+func (client *Client) call(ctx context.Context, MethodName string, args, reply interface{}) error {
+	return client.do(ctx, &Call{
+		ServerMethod: MethodName,
+		Args:         args,
+		Reply:        reply,
+	})
+}
+
+// do 发送 call 并等待回复，call 的 Metadata 和 timeout 由 ctx 得出
+func (client *Client) do(ctx context.Context, call *Call) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		call.timeout = time.Until(deadline)
+	}
+	call.Metadata = MetadataFromContext(ctx)
+	call = client.goCall(call, make(chan *Call, 1))
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq, call.ServerMethod)
+		}
 		log.Println("timeout")
 		return errors.New("rpc client: call failed: " + ctx.Err().Error())
 	case call1 := <-call.Done:
+		setReplyMetadata(ctx, call1.ReplyMetadata)
 		return call1.Error
 	}
 }
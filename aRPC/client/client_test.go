@@ -0,0 +1,1316 @@
+package client
+
+import (
+	"aRPC/edcode"
+	"aRPC/rpcserver"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// Tenant 返回请求元数据中的 tenant，并在响应元数据里带上 trace
+func (f Foo) Tenant(ctx context.Context, args int, reply *string) error {
+	*reply = rpcserver.MetadataFromContext(ctx)["tenant"]
+	return rpcserver.SetReplyMetadata(ctx, "trace", fmt.Sprintf("trace-%d", args))
+}
+
+func (f Foo) Double(args *wrapperspb.Int64Value, reply *wrapperspb.Int64Value) error {
+	reply.Value = args.Value * 2
+	return nil
+}
+
+// Repeat 返回一个很大的 reply，用来测试压缩
+func (f Foo) Repeat(args int, reply *string) error {
+	*reply = strings.Repeat("aRPC", args)
+	return nil
+}
+
+func (f Foo) Panic(args int, reply *int) error {
+	panic(fmt.Sprintf("boom %d", args))
+}
+
+// panicReply 编码时 panic，用来测试服务端回复时的 panic
+type panicReply struct{}
+
+func (panicReply) MarshalJSON() ([]byte, error) {
+	panic("marshal boom")
+}
+
+func (f Foo) BadReply(args int, reply *panicReply) error {
+	return nil
+}
+
+func (f Foo) Sleep(args int, reply *int) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	*reply = args
+	return nil
+}
+
+// Range 依次发送 0 到 args-1，在响应元数据里带上发送的个数；args 为负数时发送一个后返回错误
+func (f Foo) Range(ctx context.Context, args int, stream rpcserver.ServerStream[int]) error {
+	if args < 0 {
+		_ = stream.Send(0)
+		return errors.New("negative range")
+	}
+	for i := 0; i < args; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return rpcserver.SetReplyMetadata(ctx, "count", fmt.Sprint(args))
+}
+
+// Count 依次发送 0 到 args-1 的 protobuf 消息
+func (f Foo) Count(args *wrapperspb.Int64Value, stream rpcserver.ServerStream[*wrapperspb.Int64Value]) error {
+	for i := int64(0); i < args.Value; i++ {
+		if err := stream.Send(wrapperspb.Int64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add 返回客户端发送的所有 protobuf 消息的和
+func (f Foo) Add(stream rpcserver.ClientStream[*wrapperspb.Int64Value], reply *wrapperspb.Int64Value) error {
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply.Value += msg.Value
+	}
+}
+
+// Total 返回客户端发送的所有参数的和
+func (f Foo) Total(stream rpcserver.ClientStream[int], reply *int) error {
+	for {
+		n, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		*reply += n
+	}
+}
+
+// Echo 把客户端发送的每个参数加上前缀发回去，直到客户端半关闭
+func (f Foo) Echo(ctx context.Context, in rpcserver.ClientStream[string], out rpcserver.ServerStream[string]) error {
+	for {
+		msg, err := in.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := out.Send("echo " + msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Hold 不读取参数，直到客户端取消
+func (f Foo) Hold(stream rpcserver.ClientStream[int], reply *int) error {
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+// Ticker 一直发送到客户端取消，记录已经发送的帧数
+type Ticker struct {
+	sent int32
+	done chan error
+}
+
+func (tk *Ticker) Tick(args int, stream rpcserver.ServerStream[int]) error {
+	for i := 0; ; i++ {
+		if err := stream.Send(i); err != nil {
+			tk.done <- err
+			return err
+		}
+		atomic.AddInt32(&tk.sent, 1)
+	}
+}
+
+// Audit 记录收到的事件数
+type Audit struct{ events int32 }
+
+func (a *Audit) Record(event string, reply *int) error {
+	*reply = int(atomic.AddInt32(&a.events, 1))
+	return nil
+}
+
+// countingConn 记录和服务端之间读写的字节数
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Flaky 的每个方法前 failures 次调用返回可以重试的错误，Get 声明为幂等
+type Flaky struct {
+	failures int32
+	calls    sync.Map // method -> *int32
+}
+
+func (f *Flaky) IdempotentMethods() []string { return []string{"Get"} }
+
+func (f *Flaky) call(method string, args int, reply *int) error {
+	n, _ := f.calls.LoadOrStore(method, new(int32))
+	if atomic.AddInt32(n.(*int32), 1) <= f.failures {
+		return rpcserver.Retryable(errors.New("try again"))
+	}
+	*reply = args
+	return nil
+}
+
+func (f *Flaky) Get(args int, reply *int) error { return f.call("Get", args, reply) }
+func (f *Flaky) Put(args int, reply *int) error { return f.call("Put", args, reply) }
+
+func (f *Flaky) numCalls(method string) int32 {
+	n, _ := f.calls.LoadOrStore(method, new(int32))
+	return atomic.LoadInt32(n.(*int32))
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func startServer(t *testing.T) string {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { _ = l.Close() })
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+// 客户端的用例需要在所有的编解码方式下都能通过
+var codecs = []edcode.Type{edcode.GobType, edcode.JsonType, edcode.MsgpackType}
+
+func TestClient_Metadata(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(string(codec), func(t *testing.T) {
+			testMetadata(t, codec)
+		})
+	}
+}
+
+func testMetadata(t *testing.T, codec edcode.Type) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ctx := WithMetadata(context.Background(), map[string]string{"tenant": "t1", "token": "x"})
+	ctx = WithMetadata(ctx, map[string]string{"tenant": "t2"})
+	replyMd := make(map[string]string)
+	ctx = WithReplyMetadata(ctx, replyMd)
+	var reply string
+	err = client.Call(ctx, "Foo.Tenant", 7, &reply)
+	_assert(err == nil && reply == "t2", "expect tenant t2, got %q %v", reply, err)
+	_assert(replyMd["trace"] == "trace-7" && len(replyMd) == 1, "wrong reply metadata %v", replyMd)
+
+	var sum int
+	call := client.Go("Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum, nil)
+	call = <-call.Done
+	_assert(call.Error == nil && sum == 3 && call.ReplyMetadata == nil, "call Foo.Sum error: %v", call.Error)
+}
+
+func TestClient_Protobuf(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: edcode.ProtobufType})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	reply := &wrapperspb.Int64Value{}
+	err = client.Call(context.Background(), "Foo.Double", wrapperspb.Int64(21), reply)
+	_assert(err == nil && reply.Value == 42, "call Foo.Double error: %v", err)
+
+	// Foo.Sum takes a struct, the server should reject it without dropping the connection
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", wrapperspb.Int64(1), &sum)
+	_assert(err != nil && strings.Contains(err.Error(), "Foo.Sum can't be called with the protobuf codec"), "expect body type error, got %v", err)
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1}, &sum)
+	_assert(errors.Is(err, edcode.ErrBodyType), "expect ErrBodyType for args, got %v", err)
+	err = client.Call(context.Background(), "Foo.Double", wrapperspb.Int64(1), reply)
+	_assert(err == nil && reply.Value == 2 && client.IsAvailable(), "expect connection still usable, got %v", err)
+}
+
+func TestClient_Compression(t *testing.T) {
+	addr := startServer(t)
+	for _, codec := range codecs {
+		client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: codec, Compression: edcode.CompressZstd})
+		_assert(err == nil, "%s: dial error: %v", codec, err)
+		var reply string
+		err = client.Call(context.Background(), "Foo.Repeat", 1<<20, &reply)
+		_assert(err == nil && len(reply) == 4<<20, "%s: call Foo.Repeat error: %v", codec, err)
+		var sum int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+		_assert(err == nil && sum == 3, "%s: call Foo.Sum error: %v", codec, err)
+		_ = client.Close()
+	}
+}
+
+func TestClient_Handshake(t *testing.T) {
+	addr := startServer(t)
+	dial := func(opt *rpcserver.Option) (*Client, error) {
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial error: %v", err)
+		return NewClient(conn, opt)
+	}
+	rejected := func(err error, code rpcserver.RejectCode) bool {
+		var e *HandshakeError
+		return errors.As(err, &e) && e.Code == code && e.ServerVersion == rpcserver.ProtocolVersion
+	}
+
+	_, err := dial(&rpcserver.Option{MagicInt: 1, Version: 1, CodeType: edcode.GobType})
+	_assert(rejected(err, rpcserver.RejectBadMagic), "expect bad magic rejected, got %v", err)
+	_, err = dial(&rpcserver.Option{MagicInt: rpcserver.MagicData, Version: -1, CodeType: edcode.GobType})
+	_assert(rejected(err, rpcserver.RejectUnsupportedVersion), "expect version rejected, got %v", err)
+	_, err = dial(&rpcserver.Option{MagicInt: rpcserver.MagicData, Version: 1, CodeType: edcode.GobType, Compression: "lz4"})
+	_assert(rejected(err, rpcserver.RejectUnknownCompression), "expect compression rejected, got %v", err)
+
+	// a newer client is downgraded to the server's version
+	client, err := dial(&rpcserver.Option{MagicInt: rpcserver.MagicData, Version: 99, CodeType: edcode.JsonType})
+	_assert(err == nil && client.opt.Version == rpcserver.ProtocolVersion, "expect version negotiated, got %v", err)
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "call Foo.Sum error: %v", err)
+	_ = client.Close()
+}
+
+func TestClient_HandshakeTimeout(t *testing.T) {
+	// an old server reads the Option but never acks
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+	old := handshakeTimeout
+	handshakeTimeout = 100 * time.Millisecond
+	defer func() { handshakeTimeout = old }()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Dial("tcp", l.Addr().String(), &rpcserver.Option{ConnectTimeout: 0})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		_assert(errors.Is(err, ErrConnectTimeout), "expect connect timeout, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the handshake to time out without ConnectTimeout")
+	}
+
+	// only NewClient with Version 0 skips the ack
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	legacy, err := NewClient(conn, &rpcserver.Option{MagicInt: rpcserver.MagicData, CodeType: edcode.GobType})
+	_assert(err == nil && legacy.IsAvailable(), "expect legacy client without handshake, got %v", err)
+	_ = legacy.Close()
+
+	// the deadline is cleared after the handshake
+	client, err := Dial("tcp", startServer(t), &rpcserver.Option{ConnectTimeout: 50 * time.Millisecond})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	time.Sleep(100 * time.Millisecond)
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "call Foo.Sum error: %v", err)
+}
+
+func TestClient_Interceptor(t *testing.T) {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	hl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = hl.Close() }()
+	mux := http.NewServeMux()
+	mux.Handle(defaultRpcPath, server)
+	go func() { _ = http.Serve(hl, mux) }()
+
+	t.Run("tcp", func(t *testing.T) {
+		testInterceptor(t, Dial, l.Addr().String())
+	})
+	t.Run("http", func(t *testing.T) {
+		testInterceptor(t, DailHttp, hl.Addr().String())
+	})
+}
+
+func testInterceptor(t *testing.T, dial func(network, address string, opts ...*rpcserver.Option) (*Client, error), addr string) {
+	client, err := dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var order []string
+	var mu sync.Mutex
+	client.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		mu.Lock()
+		order = append(order, "outer:"+serviceMethod)
+		mu.Unlock()
+		ctx = WithMetadata(ctx, map[string]string{"tenant": "injected"})
+		return invoker(ctx, serviceMethod, args, reply)
+	}, func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		mu.Lock()
+		order = append(order, "inner")
+		mu.Unlock()
+		if n, ok := args.(int); ok && n < 0 {
+			return errors.New("negative args")
+		}
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+
+	var tenant string
+	err = client.Call(context.Background(), "Foo.Tenant", 1, &tenant)
+	_assert(err == nil && tenant == "injected", "expect metadata injected, got %q %v", tenant, err)
+	_assert(strings.Join(order, ",") == "outer:Foo.Tenant,inner", "wrong order %v", order)
+
+	err = client.Call(context.Background(), "Foo.Tenant", -1, &tenant)
+	_assert(err != nil && err.Error() == "negative args", "expect interceptor error, got %v", err)
+
+	call := client.Go("Foo.Tenant", 2, &tenant, nil)
+	call = <-call.Done
+	_assert(call.Error == nil && tenant == "injected", "go Foo.Tenant error: %v", call.Error)
+	_assert(call.ReplyMetadata["trace"] == "trace-2", "wrong reply metadata %v", call.ReplyMetadata)
+
+	call = <-client.Go("Foo.Tenant", -1, &tenant, nil).Done
+	_assert(call.Error != nil && call.Error.Error() == "negative args", "expect interceptor error, got %v", call.Error)
+}
+
+func TestClient_Panic(t *testing.T) {
+	addr := startServer(t)
+	for _, codec := range codecs {
+		t.Run(string(codec), func(t *testing.T) {
+			client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+			_assert(err == nil, "dial error: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply int
+			err = client.Call(context.Background(), "Foo.Panic", 1, &reply)
+			var panicErr *PanicError
+			_assert(errors.As(err, &panicErr) && errors.Is(err, rpcserver.ErrServicePanic), "expect panic error, got %v", err)
+			_assert(strings.Contains(err.Error(), "boom 1"), "expect panic value in error, got %v", err)
+
+			// the connection is still usable after a panic
+			err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+			_assert(err == nil && reply == 3 && client.IsAvailable(), "call Foo.Sum error: %v", err)
+			err = client.Call(context.Background(), "Foo.Missing", 1, &reply)
+			_assert(err != nil && !errors.As(err, &panicErr), "expect plain error, got %v", err)
+		})
+	}
+}
+
+func TestClient_ReplyPanic(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: edcode.JsonType})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// a panic while encoding the reply closes the connection instead of crashing the server
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var reply panicReply
+	err = client.Call(ctx, "Foo.BadReply", 1, &reply)
+	_assert(err != nil && ctx.Err() == nil && !client.IsAvailable(), "expect connection error, got %v", err)
+
+	client, err = Dial("tcp", addr, &rpcserver.Option{CodeType: edcode.JsonType})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "call Foo.Sum error: %v", err)
+}
+
+func TestClient_GoAway(t *testing.T) {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	var slow, reply int
+	call := client.Go("Foo.Sleep", 200, &slow, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	for i := 0; i < 100 && client.IsAvailable(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(!client.IsAvailable(), "expect client unavailable after goaway")
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrGoAway), "expect ErrGoAway, got %v", err)
+
+	// the call in flight is not failed by the goaway
+	call = <-call.Done
+	_assert(call.Error == nil && slow == 200, "in-flight call error: %v", call.Error)
+	_assert(<-shutdown == nil, "shutdown should wait for in-flight calls")
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect dial fail after shutdown")
+}
+
+// gatedListener 的连接读到数据后，在 gate 打开之前不交给服务端
+type gatedListener struct {
+	net.Listener
+	gate *sync.RWMutex
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &gatedConn{Conn: conn, gate: l.gate}, nil
+}
+
+type gatedConn struct {
+	net.Conn
+	gate *sync.RWMutex
+}
+
+func (c *gatedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.gate.RLock()
+	c.gate.RUnlock()
+	return n, err
+}
+
+func TestClient_GoAwayOnTheWire(t *testing.T) {
+	for _, inflight := range []bool{false, true} {
+		var foo Foo
+		server := rpcserver.NewServer()
+		_ = server.Register(&foo)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		gate := new(sync.RWMutex)
+		go server.Accept(&gatedListener{Listener: l, gate: gate})
+
+		client, err := Dial("tcp", l.Addr().String())
+		_assert(err == nil, "dial error: %v", err)
+		var slow, reply int
+		var call *Call
+		if inflight {
+			call = client.Go("Foo.Sleep", 200, &slow, nil)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		// the request reaches the server, but is not parsed before the shutdown starts
+		gate.Lock()
+		onWire := client.Go("Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, nil)
+		time.Sleep(20 * time.Millisecond)
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+		select {
+		case <-onWire.Done:
+		case <-time.After(time.Second):
+			t.Fatal("expect the request on the wire to fail after goaway")
+		}
+		_assert(errors.Is(onWire.Error, ErrGoAway) && IsRetryable(onWire.Error), "inflight=%v: expect ErrGoAway, got %v", inflight, onWire.Error)
+		gate.Unlock()
+		if inflight {
+			call = <-call.Done
+			_assert(call.Error == nil && slow == 200, "in-flight call error: %v", call.Error)
+		}
+		_assert(<-shutdown == nil, "shutdown error")
+		_assert(reply == 0, "expect the request on the wire not handled")
+		_ = client.Close()
+	}
+}
+
+func TestServer_ShutdownDeadline(t *testing.T) {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	call := client.Go("Foo.Sleep", 2000, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = server.Shutdown(ctx)
+	_assert(errors.Is(err, context.DeadlineExceeded) && time.Since(start) < time.Second, "expect force close at deadline, got %v", err)
+	call = <-call.Done
+	_assert(call.Error != nil, "expect in-flight call failed after force close")
+}
+
+// 在 addr 上启动服务端，addr 为空时随机选择端口，useHttp 为 true 时通过 HTTP CONNECT 服务，
+// 返回的 stop 关闭服务端和 listener
+func startServerAt(t *testing.T, addr string, useHttp bool) (stop func(), _ string) {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", addr)
+	_assert(err == nil, "listen error: %v", err)
+	if useHttp {
+		mux := http.NewServeMux()
+		mux.Handle(defaultRpcPath, server)
+		go func() { _ = http.Serve(l, mux) }()
+	} else {
+		go server.Accept(l)
+	}
+	stop = func() {
+		_ = l.Close()
+		_ = server.Shutdown(context.Background())
+	}
+	t.Cleanup(stop)
+	return stop, l.Addr().String()
+}
+
+func TestReconnectClient(t *testing.T) {
+	for _, protocol := range []string{"tcp", "http"} {
+		t.Run(protocol, func(t *testing.T) {
+			stop, addr := startServerAt(t, "", protocol == "http")
+			policy := &ReconnectPolicy{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Jitter: 0.2, OnDisconnect: QueueCalls}
+			rc, err := DialReconnect(protocol+"@"+addr, policy)
+			_assert(err == nil, "dial error: %v", err)
+			defer func() { _ = rc.Close() }()
+
+			var reply int
+			err = rc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+			_assert(err == nil && reply == 3, "call Foo.Sum error: %v", err)
+
+			stop()
+			for i := 0; i < 100 && rc.IsAvailable(); i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+			_assert(!rc.IsAvailable(), "expect disconnected after shutdown")
+
+			// the queued call is sent after the server comes back
+			call := rc.Go("Foo.Sum", &Args{Num1: 2, Num2: 3}, &reply, nil)
+			time.Sleep(50 * time.Millisecond)
+			startServerAt(t, addr, protocol == "http")
+			select {
+			case call = <-call.Done:
+				_assert(call.Error == nil && reply == 5, "queued call error: %v", call.Error)
+			case <-time.After(2 * time.Second):
+				t.Fatal("queued call should finish after reconnection")
+			}
+			_assert(rc.IsAvailable(), "expect reconnected")
+		})
+	}
+}
+
+func TestReconnectClient_FailFast(t *testing.T) {
+	stop, addr := startServerAt(t, "", false)
+	policy := &ReconnectPolicy{MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, MaxAttempts: 3, OnDisconnect: FailFast}
+	rc, err := DialReconnect("tcp@"+addr, policy)
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = rc.Close() }()
+
+	stop()
+	for i := 0; i < 100 && rc.IsAvailable(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var reply int
+	err = rc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrReconnecting), "expect ErrReconnecting, got %v", err)
+
+	// the server never comes back, give up after MaxAttempts
+	time.Sleep(200 * time.Millisecond)
+	err = rc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrReconnectFailed), "expect ErrReconnectFailed, got %v", err)
+}
+
+func TestReconnectPolicy_Backoff(t *testing.T) {
+	p := &ReconnectPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	_assert(p.backoff(0) == 100*time.Millisecond && p.backoff(2) == 400*time.Millisecond, "wrong backoff")
+	_assert(p.backoff(10) == time.Second, "backoff should not exceed MaxBackoff")
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := p.backoff(1)
+		_assert(d >= 100*time.Millisecond && d <= 300*time.Millisecond, "backoff %s out of jitter range", d)
+	}
+}
+
+func TestPool(t *testing.T) {
+	stop, addr := startServerAt(t, "", false)
+	popt := &PoolOption{MinIdle: 1, MaxOpen: 3, IdleTimeout: 50 * time.Millisecond, HealthCheckInterval: 20 * time.Millisecond}
+	p, err := DialPool("tcp@"+addr, popt)
+	_assert(err == nil, "dial pool error: %v", err)
+	defer func() { _ = p.Close() }()
+	_assert(p.Stats().Open == 1, "expect MinIdle connections, got %+v", p.Stats())
+
+	// concurrent calls are spread across at most MaxOpen connections
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			err := p.Call(context.Background(), "Foo.Sleep", 100, &reply)
+			_assert(err == nil && reply == 100, "call Foo.Sleep error: %v", err)
+		}()
+	}
+	time.Sleep(30 * time.Millisecond)
+	stats := p.Stats()
+	_assert(stats.Open == 3 && stats.InFlight == 6 && stats.Idle == 0, "expect 3 busy connections, got %+v", stats)
+	wg.Wait()
+	stats = p.Stats()
+	_assert(stats.Calls == 6 && stats.Dials == 3 && stats.InFlight == 0, "wrong stats %+v", stats)
+
+	// idle connections beyond MinIdle are closed
+	time.Sleep(150 * time.Millisecond)
+	stats = p.Stats()
+	_assert(stats.Open == 1 && stats.IdleClosed == 2, "expect idle connections closed, got %+v", stats)
+
+	// unavailable connections are removed by the health check
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	stats = p.Stats()
+	_assert(stats.Open == 0 && stats.Unavailable == 1 && stats.DialErrors > 0, "expect unavailable connection removed, got %+v", stats)
+	var reply int
+	err = p.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil, "expect call fail without server")
+}
+
+func TestRetryClient(t *testing.T) {
+	newServer := func(failures int32) (*Flaky, string) {
+		flaky := &Flaky{failures: failures}
+		server := rpcserver.NewServer()
+		_ = server.Register(flaky)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		t.Cleanup(func() { _ = l.Close() })
+		go server.Accept(l)
+		return flaky, l.Addr().String()
+	}
+	policy := &RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	flaky, addr := newServer(2)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.IsIdempotent("Flaky.Get") && !client.IsIdempotent("Flaky.Put"), "expect server advertised Flaky.Get only")
+
+	// Get is advertised idempotent by the server and succeeds on the third attempt
+	rc := NewRetryClient(client, policy)
+	var reply int
+	err = rc.Call(context.Background(), "Flaky.Get", 7, &reply)
+	_assert(err == nil && reply == 7 && flaky.numCalls("Get") == 3, "expect Get retried, got %v after %d calls", err, flaky.numCalls("Get"))
+
+	// Put is not idempotent and is called only once
+	var retryable *RetryableError
+	err = rc.Call(context.Background(), "Flaky.Put", 7, &reply)
+	_assert(errors.As(err, &retryable) && flaky.numCalls("Put") == 1, "expect Put not retried, got %v after %d calls", err, flaky.numCalls("Put"))
+
+	// the client can mark methods idempotent itself
+	flaky, addr = newServer(2)
+	client2, _ := Dial("tcp", addr)
+	defer func() { _ = client2.Close() }()
+	p := *policy
+	p.Idempotent = []string{"Flaky.Put"}
+	err = NewRetryClient(client2, &p).Call(context.Background(), "Flaky.Put", 8, &reply)
+	_assert(err == nil && reply == 8 && flaky.numCalls("Put") == 3, "expect Put retried, got %v", err)
+
+	// give up after MaxAttempts
+	flaky, addr = newServer(5)
+	client3, _ := Dial("tcp", addr)
+	defer func() { _ = client3.Close() }()
+	err = NewRetryClient(client3, policy).Call(context.Background(), "Flaky.Get", 9, &reply)
+	_assert(errors.Is(err, rpcserver.ErrRetryable) && flaky.numCalls("Get") == 3, "expect 3 attempts, got %v after %d", err, flaky.numCalls("Get"))
+}
+
+func TestPool_RemoveUnavailable(t *testing.T) {
+	addr := startServer(t)
+	p, err := DialPool("tcp@"+addr, &PoolOption{MinIdle: 2, MaxOpen: 2})
+	_assert(err == nil, "dial pool error: %v", err)
+	defer func() { _ = p.Close() }()
+
+	p.mu.Lock()
+	broken, draining := p.conns[0].Client, p.conns[1].Client
+	p.mu.Unlock()
+	broken.terminateCalls(io.ErrUnexpectedEOF)
+	draining.goAway(0)
+	var sum int
+	err = p.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "call error: %v", err)
+
+	// the shut down client is closed, the one that got GOAWAY is left to the server
+	_assert(broken.Close() == ErrShutdown, "expect the shut down client closed")
+	_assert(draining.Close() == nil, "expect the client that got GOAWAY left open")
+}
+
+func TestPool_MaxOpen(t *testing.T) {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	gate := new(sync.RWMutex)
+	go server.Accept(&gatedListener{Listener: l, gate: gate})
+
+	popt := &PoolOption{MinIdle: 1, MaxOpen: 1, HealthCheckInterval: 10 * time.Millisecond}
+	p, err := DialPool("tcp@"+l.Addr().String(), popt)
+	_assert(err == nil, "dial pool error: %v", err)
+	defer func() { _ = p.Close() }()
+
+	// the health check and a call dial at the same time while handshakes are held
+	gate.Lock()
+	p.mu.Lock()
+	_ = p.conns[0].Close()
+	p.mu.Unlock()
+	time.Sleep(30 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- p.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	gate.Unlock()
+	_assert(<-done == nil, "call error")
+	time.Sleep(30 * time.Millisecond)
+	stats := p.Stats()
+	_assert(stats.Open == 1, "expect at most MaxOpen connections, got %+v", stats)
+}
+
+func TestIsRetryable(t *testing.T) {
+	_assert(IsRetryable(ErrShutdown) && IsRetryable(ErrGoAway) && IsRetryable(io.EOF), "expect connection errors retryable")
+	_assert(IsRetryable(fmt.Errorf("%w: expect within 1s", ErrConnectTimeout)), "expect connect timeout retryable")
+	_assert(IsRetryable(serverError(rpcserver.Retryable(errors.New("busy")).Error())), "expect server retryable error retryable")
+	_assert(!IsRetryable(errors.New("rpc server: can't find method")) && !IsRetryable(serverError("boom")), "expect business errors not retryable")
+}
+
+func TestBreakers(t *testing.T) {
+	bs := NewBreakers(&BreakerOption{MinRequests: 4, ErrorRatio: 0.6, OpenTimeout: 50 * time.Millisecond, SlowThreshold: 20 * time.Millisecond})
+	call := func(addr, method string, err error) error {
+		done, openErr := bs.Allow(addr, method)
+		if openErr != nil {
+			return openErr
+		}
+		done(err)
+		return nil
+	}
+	failed := errors.New("failed")
+
+	// only the failing method is opened
+	for i := 0; i < 4; i++ {
+		_ = call("tcp@a", "Foo.Sum", nil)
+	}
+	for i := 0; i < 4; i++ {
+		_ = call("tcp@a", "Foo.Fail", failed)
+	}
+	var openErr *BreakerOpenError
+	err := call("tcp@a", "Foo.Fail", nil)
+	_assert(errors.As(err, &openErr) && openErr.ServiceMethod == "Foo.Fail" && errors.Is(err, ErrBreakerOpen), "expect method breaker open, got %v", err)
+	_assert(call("tcp@a", "Foo.Sum", nil) == nil && bs.State("tcp@a", "") == StateClosed, "expect address breaker closed")
+
+	// half-open lets a single probe through, and closes after it succeeds
+	time.Sleep(60 * time.Millisecond)
+	_assert(bs.State("tcp@a", "Foo.Fail") == StateHalfOpen, "expect half-open")
+	done, err := bs.Allow("tcp@a", "Foo.Fail")
+	_assert(err == nil, "expect probe allowed, got %v", err)
+	_assert(call("tcp@a", "Foo.Fail", nil) != nil, "expect only one probe")
+	done(nil)
+	_assert(bs.State("tcp@a", "Foo.Fail") == StateClosed, "expect closed after probe succeeded")
+
+	// slow calls count as failures and open the whole address
+	for i := 0; i < 4; i++ {
+		done, err := bs.Allow("tcp@b", "Foo.Sleep")
+		_assert(err == nil, "allow error: %v", err)
+		time.Sleep(25 * time.Millisecond)
+		done(nil)
+	}
+	err = call("tcp@b", "Foo.Sum", nil)
+	_assert(errors.As(err, &openErr) && openErr.ServiceMethod == "" && openErr.Addr == "tcp@b", "expect address breaker open, got %v", err)
+
+	// a failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	_assert(call("tcp@b", "Foo.Sum", failed) == nil && bs.State("tcp@b", "") == StateOpen, "expect open after probe failed")
+}
+
+func TestBreakers_PartialOption(t *testing.T) {
+	// the zero fields fall back to DefaultBreakerOption
+	bs := NewBreakers(&BreakerOption{SlowThreshold: time.Second})
+	for i := 0; i < 100; i++ {
+		done, err := bs.Allow("tcp@a", "Foo.Sum")
+		_assert(err == nil, "expect successful calls never open the breaker, got %v", err)
+		done(nil)
+	}
+	_assert(bs.State("tcp@a", "") == StateClosed && bs.State("tcp@a", "Foo.Sum") == StateClosed, "expect closed")
+
+	failed := errors.New("failed")
+	for i := 0; i < DefaultBreakerOption.MinRequests; i++ {
+		done, _ := bs.Allow("tcp@b", "Foo.Fail")
+		done(failed)
+	}
+	_assert(bs.State("tcp@b", "Foo.Fail") == StateOpen, "expect open after failures")
+	time.Sleep(10 * time.Millisecond)
+	_assert(bs.State("tcp@b", "Foo.Fail") == StateOpen, "expect default open timeout, got %s", bs.State("tcp@b", "Foo.Fail"))
+}
+
+func TestClient_Stream(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(string(codec), func(t *testing.T) {
+			testStream(t, codec)
+		})
+	}
+}
+
+func testStream(t *testing.T, codec edcode.Type) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// more frames than the default window, the server has to wait for window updates
+	replyMd := make(map[string]string)
+	ctx := WithReplyMetadata(context.Background(), replyMd)
+	stream, err := OpenStream[int](ctx, client, "Foo.Range", 100)
+	_assert(err == nil, "open stream error: %v", err)
+	for i := 0; i < 100; i++ {
+		n, err := stream.Recv()
+		_assert(err == nil && n == i, "expect %d, got %d %v", i, n, err)
+	}
+	_, err = stream.Recv()
+	_assert(err == io.EOF, "expect io.EOF at the end, got %v", err)
+	_, err = stream.Recv()
+	_assert(err == io.EOF, "expect io.EOF again, got %v", err)
+	_assert(replyMd["count"] == "100", "wrong reply metadata %v", replyMd)
+
+	stream, _ = OpenStream[int](context.Background(), client, "Foo.Range", -1)
+	n, err := stream.Recv()
+	_assert(err == nil && n == 0, "expect the frame before the error, got %d %v", n, err)
+	_, err = stream.Recv()
+	_assert(err != nil && err.Error() == "negative range", "expect server error, got %v", err)
+
+	// streaming methods and unary methods can't be mixed up
+	var reply int
+	err = client.Call(context.Background(), "Foo.Range", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "is a server-streaming method"), "expect streaming method error, got %v", err)
+	stream, _ = OpenStream[int](context.Background(), client, "Foo.Sum", &Args{Num1: 1, Num2: 2})
+	_, err = stream.Recv()
+	_assert(err != nil && strings.Contains(err.Error(), "is a unary method"), "expect unary method error, got %v", err)
+	_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+}
+
+func TestClient_StreamFlowControl(t *testing.T) {
+	tk := &Ticker{done: make(chan error, 1)}
+	server := rpcserver.NewServer()
+	_ = server.Register(tk)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ctx := WithStreamWindow(context.Background(), 4)
+	stream, err := OpenStream[int](ctx, client, "Ticker.Tick", 0)
+	_assert(err == nil, "open stream error: %v", err)
+	time.Sleep(100 * time.Millisecond)
+	_assert(atomic.LoadInt32(&tk.sent) == 4, "expect the server to stop at the window, sent %d", atomic.LoadInt32(&tk.sent))
+
+	for i := 0; i < 10; i++ {
+		n, err := stream.Recv()
+		_assert(err == nil && n == i, "expect %d, got %d %v", i, n, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	sent := atomic.LoadInt32(&tk.sent)
+	_assert(sent > 10 && sent <= 14, "expect at most a window ahead of the reader, sent %d", sent)
+
+	_ = stream.Close()
+	select {
+	case err := <-tk.done:
+		_assert(errors.Is(err, context.Canceled), "expect Send to fail with context.Canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the server to stop after Close")
+	}
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	_assert(err == ErrStreamClosed, "expect ErrStreamClosed after the buffered frames, got %v", err)
+	_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+}
+
+func TestClient_ClientStream(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(string(codec), func(t *testing.T) {
+			testClientStream(t, codec)
+		})
+	}
+}
+
+func testClientStream(t *testing.T, codec edcode.Type) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// more args than the server window, Send has to wait for window updates
+	up, err := OpenSendStream[int, int](context.Background(), client, "Foo.Total")
+	_assert(err == nil, "open stream error: %v", err)
+	for i := 0; i < 100; i++ {
+		_assert(up.Send(i) == nil, "send %d error", i)
+	}
+	total, err := up.CloseAndRecv()
+	_assert(err == nil && total == 4950, "expect 4950, got %d %v", total, err)
+	_assert(up.Send(1) == ErrStreamClosed, "expect ErrStreamClosed after half-close")
+
+	bidi, err := OpenBidiStream[string, string](context.Background(), client, "Foo.Echo")
+	_assert(err == nil, "open stream error: %v", err)
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = bidi.Send(fmt.Sprint(i))
+		}
+		_ = bidi.CloseSend()
+	}()
+	for i := 0; i < 100; i++ {
+		msg, err := bidi.Recv()
+		_assert(err == nil && msg == fmt.Sprintf("echo %d", i), "expect echo %d, got %q %v", i, msg, err)
+	}
+	_, err = bidi.Recv()
+	_assert(err == io.EOF, "expect io.EOF after half-close, got %v", err)
+
+	up, _ = OpenSendStream[int, int](context.Background(), client, "Foo.Range")
+	_, err = up.CloseAndRecv()
+	_assert(err != nil && strings.Contains(err.Error(), "is a server-streaming method"), "expect server-streaming method error, got %v", err)
+	_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+}
+
+func TestClient_StreamProtobuf(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: edcode.ProtobufType})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := OpenStream[*wrapperspb.Int64Value](context.Background(), client, "Foo.Count", wrapperspb.Int64(3))
+	_assert(err == nil, "open stream error: %v", err)
+	for i := int64(0); i < 3; i++ {
+		msg, err := stream.Recv()
+		_assert(err == nil && msg.GetValue() == i, "expect %d, got %v %v", i, msg, err)
+	}
+	_, err = stream.Recv()
+	_assert(err == io.EOF, "expect io.EOF, got %v", err)
+
+	up, err := OpenSendStream[*wrapperspb.Int64Value, *wrapperspb.Int64Value](context.Background(), client, "Foo.Add")
+	_assert(err == nil, "open send stream error: %v", err)
+	for i := int64(1); i <= 3; i++ {
+		_assert(up.Send(wrapperspb.Int64(i)) == nil, "send error")
+	}
+	sum, err := up.CloseAndRecv()
+	_assert(err == nil && sum.GetValue() == 6, "expect 6, got %v %v", sum, err)
+}
+
+func TestClient_StreamWindowOption(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{StreamWindow: 4})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	up, err := OpenSendStream[int, int](context.Background(), client, "Foo.Hold")
+	_assert(err == nil, "open stream error: %v", err)
+	var sent int32
+	go func() {
+		for up.Send(1) == nil {
+			atomic.AddInt32(&sent, 1)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_assert(atomic.LoadInt32(&sent) == 4, "expect Send to stop at the window in Option, sent %d", atomic.LoadInt32(&sent))
+	_ = up.Close()
+
+	// the window is capped by the server
+	client, err = Dial("tcp", addr, &rpcserver.Option{StreamWindow: rpcserver.MaxStreamWindow * 2})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.opt.StreamWindow == rpcserver.MaxStreamWindow, "expect capped window, got %d", client.opt.StreamWindow)
+}
+
+func TestClient_StreamBackpressure(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	up, err := OpenSendStream[int, int](context.Background(), client, "Foo.Hold")
+	_assert(err == nil, "open stream error: %v", err)
+	var sent int32
+	sendErr := make(chan error, 1)
+	go func() {
+		for {
+			if err := up.Send(1); err != nil {
+				sendErr <- err
+				return
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_assert(atomic.LoadInt32(&sent) == rpcserver.DefaultStreamWindow, "expect Send to stop at the server window, sent %d", atomic.LoadInt32(&sent))
+
+	// the blocked stream doesn't hold the connection
+	var sum int
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.Call(ctx, "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "expect unary call to pass a blocked stream, got %d %v", sum, err)
+
+	_ = up.Close()
+	select {
+	case err := <-sendErr:
+		_assert(err == ErrStreamClosed || err == io.EOF, "expect Send to stop after Close, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect Send to return after Close")
+	}
+	_, err = up.CloseAndRecv()
+	_assert(err == ErrStreamClosed, "expect ErrStreamClosed, got %v", err)
+}
+
+func TestClient_Notify(t *testing.T) {
+	audit := &Audit{}
+	server := rpcserver.NewServer()
+	_ = server.Register(audit)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	cc := &countingConn{Conn: conn}
+	client, err := NewClient(cc, rpcserver.DefaultOption)
+	_assert(err == nil, "new client error: %v", err)
+	defer func() { _ = client.Close() }()
+	// gob sends the type information with the first reply
+	var n int
+	_ = client.Call(context.Background(), "Audit.Record", "login", &n)
+
+	for i := 0; i < 100; i++ {
+		_assert(client.Notify("Audit.Record", "login") == nil, "notify error")
+	}
+	// errors are not replied either
+	_assert(client.Notify("Audit.Missing", "login") == nil, "notify error")
+	_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&audit.events) < 101 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(atomic.LoadInt32(&audit.events) == 101, "expect 101 events, got %d", atomic.LoadInt32(&audit.events))
+	time.Sleep(50 * time.Millisecond)
+
+	// only the replies of the normal calls come back
+	before := atomic.LoadInt64(&cc.read)
+	_ = client.Call(context.Background(), "Audit.Record", "login", &n)
+	first := atomic.LoadInt64(&cc.read) - before
+	_assert(n == 102, "expect the call after the notifications, got %d", n)
+	before = atomic.LoadInt64(&cc.read)
+	_ = client.Call(context.Background(), "Audit.Record", "login", &n)
+	second := atomic.LoadInt64(&cc.read) - before
+	_assert(first == second, "expect no reply for one-way requests, read %d bytes for a call and %d for the next", first, second)
+
+	_ = client.Close()
+	_assert(client.Notify("Audit.Record", "login") == ErrShutdown, "expect ErrShutdown after Close")
+}
+
+func TestClient_Batch(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(string(codec), func(t *testing.T) {
+			testBatch(t, codec)
+		})
+	}
+}
+
+func testBatch(t *testing.T, codec edcode.Type) {
+	var foo Foo
+	audit := &Audit{}
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	_ = server.Register(audit)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String(), &rpcserver.Option{CodeType: codec})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	batch := client.Batch()
+	sums := make([]int, 10)
+	calls := make([]*BatchCall, 10)
+	for i := range sums {
+		calls[i] = batch.Add("Foo.Sum", &Args{Num1: i, Num2: i}, &sums[i])
+	}
+	var tenant string
+	tenantCall := batch.Add("Foo.Tenant", 1, &tenant)
+	panicCall := batch.Add("Foo.Panic", 1, new(int))
+	missing := batch.Add("Foo.Missing", 1, new(int))
+	streaming := batch.Add("Foo.Range", 1, new(int))
+	ctx := WithMetadata(context.Background(), map[string]string{"tenant": "t1"})
+	err = batch.Do(ctx)
+	_assert(err == nil, "batch error: %v", err)
+	for i, call := range calls {
+		_assert(call.Error == nil && sums[i] == 2*i, "expect %d, got %d %v", 2*i, sums[i], call.Error)
+	}
+	_assert(tenantCall.Error == nil && tenant == "t1", "expect the batch to share metadata, got %q %v", tenant, tenantCall.Error)
+	_assert(errors.Is(panicCall.Error, rpcserver.ErrServicePanic), "expect panic error, got %v", panicCall.Error)
+	_assert(missing.Error != nil && strings.Contains(missing.Error.Error(), "can't find method"), "expect missing method error, got %v", missing.Error)
+	_assert(streaming.Error != nil && strings.Contains(streaming.Error.Error(), "is a server-streaming method"), "expect streaming method error, got %v", streaming.Error)
+
+	// entries run concurrently by default and one after another on request
+	batch = client.Batch()
+	for i := 0; i < 5; i++ {
+		batch.Add("Foo.Sleep", 100, nil)
+	}
+	start := time.Now()
+	_ = batch.Do(context.Background())
+	_assert(time.Since(start) < 300*time.Millisecond, "expect concurrent batch, took %s", time.Since(start))
+
+	batch = client.Batch()
+	batch.Sequential = true
+	counts := make([]int, 5)
+	for i := range counts {
+		batch.Add("Audit.Record", "login", &counts[i])
+	}
+	err = batch.Do(context.Background())
+	for i, n := range counts {
+		_assert(err == nil && n == i+1, "expect sequential batch to run in order, got %v %v", counts, err)
+	}
+	_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+}
+
+func TestClient_BatchLimit(t *testing.T) {
+	var foo Foo
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	server.SetBatchLimit(4, 2)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	batch := client.Batch()
+	for i := 0; i < 5; i++ {
+		batch.Add("Foo.Sum", &Args{Num1: i, Num2: i}, new(int))
+	}
+	err = batch.Do(context.Background())
+	_assert(err != nil && strings.Contains(err.Error(), "exceed the limit 4"), "expect the batch rejected, got %v", err)
+
+	// two at a time
+	batch = client.Batch()
+	for i := 0; i < 4; i++ {
+		batch.Add("Foo.Sleep", 100, nil)
+	}
+	start := time.Now()
+	err = batch.Do(context.Background())
+	elapsed := time.Since(start)
+	_assert(err == nil && elapsed >= 200*time.Millisecond && elapsed < 350*time.Millisecond, "expect 2 concurrent calls, took %s %v", elapsed, err)
+}
+
+// 批量调用中的每个调用不应该比热连接上的一次普通调用更大
+func TestClient_BatchSize(t *testing.T) {
+	addr := startServer(t)
+	for _, codec := range codecs {
+		if codec == edcode.ProtobufType {
+			continue
+		}
+		conn, _ := net.Dial("tcp", addr)
+		cc := &countingConn{Conn: conn}
+		client, err := NewClient(cc, &rpcserver.Option{MagicInt: rpcserver.MagicData, Version: rpcserver.ProtocolVersion, CodeType: codec})
+		_assert(err == nil, "new client error: %v", err)
+		var reply int
+		_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		written, read := atomic.LoadInt64(&cc.written), atomic.LoadInt64(&cc.read)
+		_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		unaryWritten, unaryRead := atomic.LoadInt64(&cc.written)-written, atomic.LoadInt64(&cc.read)-read
+
+		batch := client.Batch()
+		for i := 0; i < 100; i++ {
+			batch.Add("Foo.Sum", &Args{Num1: i, Num2: i}, &reply)
+		}
+		written, read = atomic.LoadInt64(&cc.written), atomic.LoadInt64(&cc.read)
+		_assert(batch.Do(context.Background()) == nil && reply == 198, "%s: batch error", codec)
+		batchWritten, batchRead := atomic.LoadInt64(&cc.written)-written, atomic.LoadInt64(&cc.read)-read
+		t.Logf("%s: unary %d/%d bytes, batch of 100 %d/%d bytes", codec, unaryWritten, unaryRead, batchWritten, batchRead)
+		_assert(batchWritten < 100*unaryWritten && batchRead < 100*unaryRead, "%s: expect batch entries smaller than unary calls, got %d/%d against %d/%d",
+			codec, batchWritten, batchRead, unaryWritten, unaryRead)
+		_ = client.Close()
+	}
+}
+
+func TestClient_BatchProtobuf(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr, &rpcserver.Option{CodeType: edcode.ProtobufType})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	batch := client.Batch()
+	call := batch.Add("Foo.Double", wrapperspb.Int64(2), &wrapperspb.Int64Value{})
+	err = batch.Do(context.Background())
+	_assert(errors.Is(err, ErrBatchUnsupported) && errors.Is(call.Error, ErrBatchUnsupported), "expect ErrBatchUnsupported, got %v", err)
+	var reply wrapperspb.Int64Value
+	err = client.Call(context.Background(), "Foo.Double", wrapperspb.Int64(2), &reply)
+	_assert(err == nil && reply.Value == 4, "expect the connection to work after a rejected batch, got %v", err)
+}
+
+func TestClient_BatchEmpty(t *testing.T) {
+	addr := startServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+
+	_assert(errors.Is(client.Batch().Do(context.Background()), ErrBatchEmpty), "expect ErrBatchEmpty without calls")
+	// gob can't encode a nil value or a channel
+	batch := client.Batch()
+	nilCall := batch.Add("Foo.Sum", nil, new(int))
+	chanCall := batch.Add("Foo.Sum", make(chan int), new(int))
+	err = batch.Do(context.Background())
+	_assert(errors.Is(err, ErrBatchEmpty) && nilCall.Error != nil && chanCall.Error != nil, "expect ErrBatchEmpty when nothing encodes, got %v", err)
+}
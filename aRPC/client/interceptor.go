@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+)
+
+// Invoker 调用链的下一环，最后一环会真正把请求发给服务端并等待响应
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// Interceptor 包裹 Call 和 Go 发出的每一次调用，可以修改 ctx（例如用 WithMetadata 注入元数据）、
+// 多次调用 invoker 实现重试，或者不调用 invoker 直接返回 error
+type Interceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// Use 添加拦截器，先添加的在外层，按添加的顺序执行
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.interceptors = append(client.interceptors, interceptors...)
+}
+
+// chain 把拦截器和 invoker 组合成一个 Invoker，第一个拦截器在最外层
+func chain(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// 有拦截器时 Go 在新的 goroutine 中经过拦截器链调用，完成后再通知 call.Done
+func (client *Client) goIntercepted(interceptors []Interceptor, call *Call) {
+	goInvoke(chain(interceptors, client.call), call)
+}
+
+// goCaller 新建一个 call，在新的 goroutine 中用 c.Call 完成，
+// 包装了 Client 的 Pool、ReconnectClient 等用它实现 Go
+func goCaller(c Caller, serviceMethod string, args, reply interface{}, ch chan *Call) *Call {
+	call := &Call{
+		ServerMethod: serviceMethod,
+		Args:         args,
+		Reply:        reply,
+		Done:         doneChan(ch),
+	}
+	goInvoke(c.Call, call)
+	return call
+}
+
+// goInvoke 在新的 goroutine 中用 invoker 完成 call，完成后通知 call.Done
+func goInvoke(invoker Invoker, call *Call) {
+	go func() {
+		replyMd := make(map[string]string)
+		ctx := WithReplyMetadata(context.Background(), replyMd)
+		call.Error = invoker(ctx, call.ServerMethod, call.Args, call.Reply)
+		if len(replyMd) > 0 {
+			call.ReplyMetadata = replyMd
+		}
+		call.done()
+	}()
+}
@@ -0,0 +1,41 @@
+package client
+
+import "context"
+
+type metadataKey struct{}
+type replyMetadataKey struct{}
+
+// WithMetadata 把元数据附加到 ctx 上，Call 时随请求发给服务端；
+// ctx 上已有的元数据会被保留，同名的键以 md 为准
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	old := MetadataFromContext(ctx)
+	merged := make(map[string]string, len(old)+len(md))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// MetadataFromContext 返回 WithMetadata 附加在 ctx 上的元数据，没有时返回 nil
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
+
+// WithReplyMetadata Call 返回时会把服务端的响应元数据写入 md
+func WithReplyMetadata(ctx context.Context, md map[string]string) context.Context {
+	return context.WithValue(ctx, replyMetadataKey{}, md)
+}
+
+func setReplyMetadata(ctx context.Context, replyMd map[string]string) {
+	md, ok := ctx.Value(replyMetadataKey{}).(map[string]string)
+	if !ok || md == nil {
+		return
+	}
+	for k, v := range replyMd {
+		md[k] = v
+	}
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"aRPC/rpcserver"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// PoolOption 连接池的参数
+type PoolOption struct {
+	MinIdle             int           // 至少保持的连接数
+	MaxOpen             int           // 最多打开的连接数
+	IdleTimeout         time.Duration // 连接空闲超过这个时间后关闭，但保留 MinIdle 个，0 表示不关闭
+	HealthCheckInterval time.Duration // 检查连接是否可用、关闭空闲连接的间隔
+}
+
+var DefaultPoolOption = &PoolOption{
+	MinIdle:             1,
+	MaxOpen:             4,
+	IdleTimeout:         time.Minute,
+	HealthCheckInterval: 10 * time.Second,
+}
+
+// PoolStats 连接池的统计信息
+type PoolStats struct {
+	Open     int // 当前打开的连接数
+	Idle     int // 没有正在进行的调用的连接数
+	InFlight int // 正在进行的调用数
+
+	Calls       uint64 // 累计的调用数
+	Dials       uint64 // 累计建立的连接数
+	DialErrors  uint64 // 累计建立连接失败的次数
+	IdleClosed  uint64 // 因为空闲超时关闭的连接数
+	Unavailable uint64 // 因为不可用被移除的连接数
+}
+
+type poolConn struct {
+	*Client
+	inflight int
+	lastUsed time.Time
+}
+
+// Pool 到同一个地址的多个连接，每次调用选择正在进行的调用最少的连接，
+// 所有连接都在使用中并且没有达到 MaxOpen 时建立新的连接
+type Pool struct {
+	rpcAddr string
+	opt     *rpcserver.Option
+	popt    PoolOption
+
+	mu           sync.Mutex // protect following
+	conns        []*poolConn
+	dialing      int
+	closed       bool
+	closeCh      chan struct{}
+	interceptors []Interceptor
+	stats        PoolStats
+}
+
+var _ io.Closer = (*Pool)(nil)
+
+// DialPool 建立到 rpcAddr（格式与 XDial 相同）的连接池，先建立 MinIdle 个连接，
+// popt 为 nil 时使用 DefaultPoolOption，MaxOpen 至少为 1
+func DialPool(rpcAddr string, popt *PoolOption, opts ...*rpcserver.Option) (*Pool, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if popt == nil {
+		popt = DefaultPoolOption
+	}
+	p := &Pool{
+		rpcAddr: rpcAddr,
+		opt:     opt,
+		popt:    *popt,
+		closeCh: make(chan struct{}),
+	}
+	if p.popt.MaxOpen < 1 {
+		p.popt.MaxOpen = 1
+	}
+	if p.popt.MinIdle > p.popt.MaxOpen {
+		p.popt.MinIdle = p.popt.MaxOpen
+	}
+	for i := 0; i < p.popt.MinIdle; i++ {
+		c, err := p.dial()
+		if err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		p.conns = append(p.conns, &poolConn{Client: c, lastUsed: time.Now()})
+	}
+	if p.popt.HealthCheckInterval > 0 {
+		go p.maintain()
+	}
+	return p, nil
+}
+
+// Close 关闭所有连接
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrShutdown
+	}
+	p.closed = true
+	close(p.closeCh)
+	for _, pc := range p.conns {
+		_ = pc.Close()
+	}
+	p.conns = nil
+	return nil
+}
+
+// Use 添加拦截器，已经建立和之后建立的每个连接都会使用这些拦截器
+func (p *Pool) Use(interceptors ...Interceptor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interceptors = append(p.interceptors, interceptors...)
+	for _, pc := range p.conns {
+		pc.Use(interceptors...)
+	}
+}
+
+// IsIdempotent 服务端是否声明了 serviceMethod 是幂等的，池中的连接都连到同一个地址
+func (p *Pool) IsIdempotent(serviceMethod string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns) > 0 && p.conns[0].IsIdempotent(serviceMethod)
+}
+
+// Stats 返回连接池当前的统计信息
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Open = len(p.conns)
+	for _, pc := range p.conns {
+		if pc.inflight == 0 {
+			stats.Idle++
+		}
+		stats.InFlight += pc.inflight
+	}
+	return stats
+}
+
+// Call 选择一个连接调用，请求因为连接断开没有发出时换一个连接
+func (p *Pool) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	for {
+		pc, err := p.get()
+		if err != nil {
+			return err
+		}
+		err = pc.Call(ctx, serviceMethod, args, reply)
+		p.put(pc)
+		if !errors.Is(err, ErrShutdown) && !errors.Is(err, ErrGoAway) {
+			return err
+		}
+	}
+}
+
+// Go 异步调用 Call，请求没有发出时同样换一个连接，完成后通知 call.Done
+func (p *Pool) Go(serviceMethod string, args, reply interface{}, ch chan *Call) *Call {
+	return goCaller(p, serviceMethod, args, reply, ch)
+}
+
+func (p *Pool) dial() (*Client, error) {
+	c, err := XDial(p.rpcAddr, p.opt)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.DialErrors++
+		return nil, err
+	}
+	p.stats.Dials++
+	c.Use(p.interceptors...)
+	return c, nil
+}
+
+// get 返回正在进行的调用最少的可用连接，必要时建立新的连接
+func (p *Pool) get() (*poolConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	p.removeUnavailable()
+	best := p.leastBusy()
+	if best != nil && (best.inflight == 0 || len(p.conns)+p.dialing >= p.popt.MaxOpen) {
+		p.acquire(best)
+		p.mu.Unlock()
+		return best, nil
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	c, err := p.dial()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		//建立新连接失败时仍然可以使用已有的连接
+		if best != nil && best.IsAvailable() && !p.closed {
+			p.acquire(best)
+			return best, nil
+		}
+		return nil, err
+	}
+	if p.closed {
+		_ = c.Close()
+		return nil, ErrShutdown
+	}
+	//拨号的时候其他拨号已经用完了 MaxOpen，改用已有的连接
+	if len(p.conns) >= p.popt.MaxOpen {
+		_ = c.Close()
+		best = p.leastBusy()
+		p.acquire(best)
+		return best, nil
+	}
+	pc := &poolConn{Client: c}
+	p.conns = append(p.conns, pc)
+	p.acquire(pc)
+	return pc, nil
+}
+
+// leastBusy 返回正在进行的调用最少的连接，调用方持有 p.mu
+func (p *Pool) leastBusy() *poolConn {
+	var best *poolConn
+	for _, pc := range p.conns {
+		if best == nil || pc.inflight < best.inflight {
+			best = pc
+		}
+	}
+	return best
+}
+
+func (p *Pool) acquire(pc *poolConn) {
+	pc.inflight++
+	pc.lastUsed = time.Now()
+	p.stats.Calls++
+}
+
+func (p *Pool) put(pc *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.inflight--
+	pc.lastUsed = time.Now()
+}
+
+// removeUnavailable 移除并关闭不可用的连接，调用方持有 p.mu。
+// 收到 GOAWAY 的连接上可能还有调用在等待回复，不关闭，由服务端关闭
+func (p *Pool) removeUnavailable() {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if pc.IsAvailable() {
+			conns = append(conns, pc)
+			continue
+		}
+		if !pc.IsGoingAway() {
+			_ = pc.Close()
+		}
+		p.stats.Unavailable++
+	}
+	p.conns = conns
+}
+
+// maintain 定期移除不可用的连接，关闭空闲超时的连接，并补足 MinIdle 个连接
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(p.popt.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closeCh:
+			return
+		}
+		p.mu.Lock()
+		p.removeUnavailable()
+		if p.popt.IdleTimeout > 0 {
+			open := len(p.conns)
+			conns := p.conns[:0]
+			for _, pc := range p.conns {
+				if open > p.popt.MinIdle && pc.inflight == 0 && time.Since(pc.lastUsed) > p.popt.IdleTimeout {
+					_ = pc.Close()
+					p.stats.IdleClosed++
+					open--
+					continue
+				}
+				conns = append(conns, pc)
+			}
+			p.conns = conns
+		}
+		p.mu.Unlock()
+		if !p.refill() {
+			return
+		}
+	}
+}
+
+// refill 补足 MinIdle 个连接，和 get 一样拨号前先占用名额，不会超过 MaxOpen；
+// 连接池已经关闭时返回 false
+func (p *Pool) refill() bool {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return false
+		}
+		open := len(p.conns) + p.dialing
+		if open >= p.popt.MinIdle || open >= p.popt.MaxOpen {
+			p.mu.Unlock()
+			return true
+		}
+		p.dialing++
+		p.mu.Unlock()
+
+		c, err := p.dial()
+		p.mu.Lock()
+		p.dialing--
+		if err != nil {
+			p.mu.Unlock()
+			log.Println("rpc client: pool dial error:", err)
+			return true
+		}
+		if p.closed {
+			p.mu.Unlock()
+			_ = c.Close()
+			return false
+		}
+		//没有连接时 get 不等待名额，可能已经先补满了
+		if len(p.conns) >= p.popt.MaxOpen {
+			p.mu.Unlock()
+			_ = c.Close()
+			return true
+		}
+		p.conns = append(p.conns, &poolConn{Client: c, lastUsed: time.Now()})
+		p.mu.Unlock()
+	}
+}
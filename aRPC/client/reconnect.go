@@ -0,0 +1,274 @@
+package client
+
+import (
+	"aRPC/rpcserver"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DisconnectPolicy 断线重连期间新的调用的处理方式
+type DisconnectPolicy int
+
+const (
+	FailFast   DisconnectPolicy = iota // 立即返回 ErrReconnecting
+	QueueCalls                         // 等待重连成功后再发送，直到 ctx 结束
+)
+
+// ReconnectPolicy 重连的退避参数，第 n 次重连前等待 MinBackoff*2^n，
+// 不超过 MaxBackoff，并加上 ±Jitter 比例的随机抖动，避免所有客户端同时重连
+type ReconnectPolicy struct {
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	Jitter       float64 // 0 到 1 之间
+	MaxAttempts  int     // 每次断线最多重连的次数，0 表示不限制
+	OnDisconnect DisconnectPolicy
+	MaxQueue     int // QueueCalls 时最多等待的调用数，0 表示不限制
+}
+
+// DefaultReconnectPolicy 断线时排队等待，一直重连
+var DefaultReconnectPolicy = &ReconnectPolicy{
+	MinBackoff:   100 * time.Millisecond,
+	MaxBackoff:   10 * time.Second,
+	Jitter:       0.2,
+	OnDisconnect: QueueCalls,
+}
+
+var (
+	ErrReconnecting       = errors.New("rpc client: connection lost, reconnecting")
+	ErrReconnectQueueFull = errors.New("rpc client: too many calls waiting for reconnection")
+	ErrReconnectFailed    = errors.New("rpc client: reconnect attempts exhausted")
+)
+
+// ReconnectClient 连接断开或者收到 GOAWAY 后自动重新拨号原来的地址，
+// 重新握手，之后的调用使用新的连接；已经发出的调用不会重发
+type ReconnectClient struct {
+	rpcAddr string
+	opt     *rpcserver.Option
+	policy  ReconnectPolicy
+
+	mu           sync.Mutex    // protect following
+	client       *Client       // 断线时为 nil
+	ready        chan struct{} // 重连成功或者放弃重连时关闭
+	waiting      int
+	failed       error
+	closed       bool
+	closeCh      chan struct{}
+	interceptors []Interceptor
+}
+
+var _ io.Closer = (*ReconnectClient)(nil)
+
+// DialReconnect 拨号 rpcAddr（格式与 XDial 相同，支持 tcp@ 和 http@），
+// 第一次拨号失败时直接返回错误。policy 为 nil 时使用 DefaultReconnectPolicy，
+// MinBackoff 和 MaxBackoff 为 0 时使用默认值
+func DialReconnect(rpcAddr string, policy *ReconnectPolicy, opts ...*rpcserver.Option) (*ReconnectClient, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		policy = DefaultReconnectPolicy
+	}
+	p := *policy
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = DefaultReconnectPolicy.MinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultReconnectPolicy.MaxBackoff
+	}
+	c, err := XDial(rpcAddr, opt)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectClient{
+		rpcAddr: rpcAddr,
+		opt:     opt,
+		policy:  p,
+		client:  c,
+		ready:   make(chan struct{}),
+		closeCh: make(chan struct{}),
+	}
+	close(rc.ready)
+	go rc.watch(c)
+	return rc, nil
+}
+
+// Close 关闭当前连接并停止重连，等待重连的调用返回 ErrShutdown
+func (rc *ReconnectClient) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return ErrShutdown
+	}
+	rc.closed = true
+	close(rc.closeCh)
+	if rc.client != nil {
+		return rc.client.Close()
+	}
+	return nil
+}
+
+// IsAvailable 当前连接可用时返回 true
+func (rc *ReconnectClient) IsAvailable() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return !rc.closed && rc.client != nil && rc.client.IsAvailable()
+}
+
+// IsIdempotent 当前连接的服务端是否声明了 serviceMethod 是幂等的
+func (rc *ReconnectClient) IsIdempotent(serviceMethod string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.client != nil && rc.client.IsIdempotent(serviceMethod)
+}
+
+// Use 添加拦截器，重连后的新连接也会使用这些拦截器
+func (rc *ReconnectClient) Use(interceptors ...Interceptor) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.interceptors = append(rc.interceptors, interceptors...)
+	if rc.client != nil {
+		rc.client.Use(interceptors...)
+	}
+}
+
+// Call 连接可用时直接调用；请求因为断线没有发出时，按 OnDisconnect 等待重连后再发送
+func (rc *ReconnectClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	for {
+		c, err := rc.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.Call(ctx, serviceMethod, args, reply)
+		if !errors.Is(err, ErrShutdown) && !errors.Is(err, ErrGoAway) {
+			return err
+		}
+		rc.disconnected(c)
+	}
+}
+
+// Go 异步调用 Call，连接断开时和 Call 一样等待重连，完成后通知 call.Done
+func (rc *ReconnectClient) Go(serviceMethod string, args, reply interface{}, ch chan *Call) *Call {
+	return goCaller(rc, serviceMethod, args, reply, ch)
+}
+
+// get 返回当前可用的连接，断线时按 OnDisconnect 立即失败或者等待重连
+func (rc *ReconnectClient) get(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		switch {
+		case rc.closed:
+			rc.mu.Unlock()
+			return nil, ErrShutdown
+		case rc.failed != nil:
+			rc.mu.Unlock()
+			return nil, rc.failed
+		case rc.client != nil:
+			c := rc.client
+			rc.mu.Unlock()
+			return c, nil
+		case rc.policy.OnDisconnect == FailFast:
+			rc.mu.Unlock()
+			return nil, ErrReconnecting
+		case rc.policy.MaxQueue > 0 && rc.waiting >= rc.policy.MaxQueue:
+			rc.mu.Unlock()
+			return nil, ErrReconnectQueueFull
+		}
+		rc.waiting++
+		ready := rc.ready
+		rc.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-rc.closeCh:
+		case <-ctx.Done():
+		}
+		rc.mu.Lock()
+		rc.waiting--
+		rc.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, errors.New("rpc client: call failed: " + ctx.Err().Error())
+		}
+	}
+}
+
+// disconnected c 不能再发送新的请求，之后的调用等待重连，重复调用没有影响
+func (rc *ReconnectClient) disconnected(c *Client) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.client != c {
+		return
+	}
+	rc.client = nil
+	rc.ready = make(chan struct{})
+}
+
+// watch 等待当前连接不可用，然后重连，直到 Close 或者放弃重连
+func (rc *ReconnectClient) watch(c *Client) {
+	for c != nil {
+		select {
+		case <-c.unavailable:
+		case <-rc.closeCh:
+			return
+		}
+		//收到 GOAWAY 的旧连接还有请求在等待回复，由服务端关闭，这里不主动关闭
+		rc.disconnected(c)
+		c = rc.reconnect()
+	}
+}
+
+func (rc *ReconnectClient) reconnect() *Client {
+	for attempt := 0; rc.policy.MaxAttempts == 0 || attempt < rc.policy.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(rc.policy.backoff(attempt)):
+		case <-rc.closeCh:
+			return nil
+		}
+		c, err := XDial(rc.rpcAddr, rc.opt)
+		if err != nil {
+			log.Println("rpc client: reconnect error:", err)
+			continue
+		}
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			_ = c.Close()
+			return nil
+		}
+		c.Use(rc.interceptors...)
+		rc.client = c
+		close(rc.ready)
+		rc.mu.Unlock()
+		return c
+	}
+	rc.mu.Lock()
+	rc.failed = ErrReconnectFailed
+	close(rc.ready)
+	rc.mu.Unlock()
+	return nil
+}
+
+// backoff 第 attempt 次（从 0 开始）重连前等待的时间
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	return backoff(p.MinBackoff, p.MaxBackoff, p.Jitter, attempt)
+}
+
+// backoff 指数退避：min*2^attempt，不超过 max，再加上 ±jitter 比例的随机抖动
+func backoff(min, max time.Duration, jitter float64, attempt int) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * jitter * float64(d))
+	}
+	return d
+}
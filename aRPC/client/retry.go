@@ -0,0 +1,110 @@
+package client
+
+import (
+	"aRPC/rpcserver"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Caller Client、ReconnectClient、Pool 和 xclient.XClient 都实现了 Caller
+type Caller interface {
+	Call(ctx context.Context, serviceMethod string, args, reply interface{}) error
+}
+
+// IdempotentChecker 能告诉调用方服务端在握手时声明了哪些幂等方法
+type IdempotentChecker interface {
+	IsIdempotent(serviceMethod string) bool
+}
+
+// RetryPolicy 重试只对幂等的方法生效：Idempotent 中列出的方法，
+// 或者 Caller 实现了 IdempotentChecker 并且服务端声明了的方法。
+// 第 n 次重试前等待 MinBackoff*2^n，不超过 MaxBackoff，并加上 ±Jitter 比例的随机抖动
+type RetryPolicy struct {
+	MaxAttempts int // 包括第一次调用的总次数，不大于 1 时不重试
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+	Idempotent  []string             // 客户端认为幂等的方法 "Service.Method"
+	RetryOn     func(err error) bool // 哪些错误可以重试，nil 时使用 IsRetryable
+}
+
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts: 3,
+	MinBackoff:  50 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	Jitter:      0.2,
+}
+
+// IsRetryable 默认可以重试的错误：连接断开或正在关闭、建立连接超时，
+// 以及服务端用 rpcserver.Retryable 标记的错误
+func IsRetryable(err error) bool {
+	for _, target := range []error{
+		ErrShutdown, ErrGoAway, ErrReconnecting, ErrConnectTimeout,
+		io.EOF, io.ErrUnexpectedEOF, rpcserver.ErrRetryable,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	var netErr *net.OpError
+	return errors.As(err, &netErr)
+}
+
+// RetryClient 按照 RetryPolicy 重试幂等的方法，其余方法只调用一次
+type RetryClient struct {
+	caller     Caller
+	policy     RetryPolicy
+	idempotent map[string]bool
+}
+
+// NewRetryClient policy 为 nil 时使用 DefaultRetryPolicy
+func NewRetryClient(caller Caller, policy *RetryPolicy) *RetryClient {
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	rc := &RetryClient{
+		caller:     caller,
+		policy:     *policy,
+		idempotent: make(map[string]bool),
+	}
+	if rc.policy.RetryOn == nil {
+		rc.policy.RetryOn = IsRetryable
+	}
+	for _, method := range policy.Idempotent {
+		rc.idempotent[method] = true
+	}
+	return rc
+}
+
+// IsIdempotent 客户端或者服务端是否声明了 serviceMethod 是幂等的
+func (rc *RetryClient) IsIdempotent(serviceMethod string) bool {
+	if rc.idempotent[serviceMethod] {
+		return true
+	}
+	checker, ok := rc.caller.(IdempotentChecker)
+	return ok && checker.IsIdempotent(serviceMethod)
+}
+
+// Call 调用失败、错误可以重试并且方法是幂等的时候，等待一段时间后重试，直到 ctx 结束
+func (rc *RetryClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = rc.caller.Call(ctx, serviceMethod, args, reply)
+		if err == nil || attempt+1 >= rc.policy.MaxAttempts || !rc.policy.RetryOn(err) || !rc.IsIdempotent(serviceMethod) {
+			return err
+		}
+		select {
+		case <-time.After(backoff(rc.policy.MinBackoff, rc.policy.MaxBackoff, rc.policy.Jitter, attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Go 异步调用 Call，重试在后台进行，call.Done 只收到最后一次调用的结果
+func (rc *RetryClient) Go(serviceMethod string, args, reply interface{}, ch chan *Call) *Call {
+	return goCaller(rc, serviceMethod, args, reply, ch)
+}
@@ -0,0 +1,399 @@
+package client
+
+import (
+	"aRPC/edcode"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultStreamWindow 没有用 WithStreamWindow 指定时，服务端在客户端 Recv 之前最多发送的帧数
+const DefaultStreamWindow = 32
+
+type streamWindowKey struct{}
+
+// WithStreamWindow 设置 OpenStream 和 OpenBidiStream 的接收窗口，即客户端最多缓存的帧数，n 不大于 0 时忽略
+func WithStreamWindow(ctx context.Context, n int) context.Context {
+	if n <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, streamWindowKey{}, uint32(n))
+}
+
+func streamWindow(ctx context.Context) uint32 {
+	if n, ok := ctx.Value(streamWindowKey{}).(uint32); ok {
+		return n
+	}
+	return DefaultStreamWindow
+}
+
+var (
+	ErrStreamClosed         = errors.New("rpc client: stream is closed")
+	errStreamWindowExceeded = errors.New("rpc client: stream window exceeded")
+	errUnexpectedFrame      = errors.New("rpc client: unexpected stream frame")
+)
+
+// Stream 服务端流式方法（见 rpcserver.ServerStream）的接收端
+type Stream[R any] struct {
+	s *clientStream
+}
+
+// OpenStream 调用服务端流式方法 serviceMethod。ctx 的 deadline 和元数据随请求发给服务端，
+// ctx 结束或者 Close 时通知服务端取消；流结束后服务端的响应元数据写入 WithReplyMetadata 的 map。
+// 请求没有发出时返回错误，发送失败和服务端的错误由 Recv 返回
+func OpenStream[R any](ctx context.Context, client *Client, serviceMethod string, args interface{}) (*Stream[R], error) {
+	s, err := client.openStream(ctx, &Call{ServerMethod: serviceMethod, Args: args, endStream: true}, newValue[R])
+	if err != nil {
+		return nil, err
+	}
+	return &Stream[R]{s: s}, nil
+}
+
+// Recv 返回下一个回复，流正常结束时返回 io.EOF，否则返回服务端或者连接的错误。
+// 每读完半个窗口的帧通知服务端继续发送，Recv 不能并发调用
+func (s *Stream[R]) Recv() (R, error) {
+	return recvAs[R](s.s)
+}
+
+// Close 放弃剩下的回复并通知服务端取消，之后 Recv 返回已经收到的回复，然后返回 ErrStreamClosed
+func (s *Stream[R]) Close() error {
+	return s.s.close()
+}
+
+// SendStream 客户端流式方法（见 rpcserver.ClientStream）的发送端
+type SendStream[A, R any] struct {
+	s *clientStream
+}
+
+// OpenSendStream 调用客户端流式方法 serviceMethod，用 Send 发送参数，用 CloseAndRecv 得到回复。
+// ctx 的作用和 OpenStream 相同
+func OpenSendStream[A, R any](ctx context.Context, client *Client, serviceMethod string) (*SendStream[A, R], error) {
+	s, err := client.openStream(ctx, &Call{ServerMethod: serviceMethod, Args: invalidRequest, Reply: newValue[R]()}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SendStream[A, R]{s: s}, nil
+}
+
+// Send 发送一个参数，服务端的接收窗口用完时阻塞；流已经结束时返回 io.EOF，
+// 结束的原因由 CloseAndRecv 返回。Send 和 CloseAndRecv 不能并发调用
+func (s *SendStream[A, R]) Send(args A) error {
+	return s.s.send(args)
+}
+
+// CloseAndRecv 半关闭，等待服务端方法返回的回复或者错误
+func (s *SendStream[A, R]) CloseAndRecv() (R, error) {
+	_ = s.s.closeSend()
+	<-s.s.end
+	if s.s.err != io.EOF {
+		var zero R
+		return zero, s.s.err
+	}
+	return valueOf[R](s.s.call.Reply), nil
+}
+
+// Close 放弃调用并通知服务端取消
+func (s *SendStream[A, R]) Close() error {
+	return s.s.close()
+}
+
+// BidiStream 双向流式方法的两端，发送和接收可以在两个 goroutine 中同时进行
+type BidiStream[A, R any] struct {
+	s *clientStream
+}
+
+// OpenBidiStream 调用双向流式方法 serviceMethod，ctx 的作用和 OpenStream 相同
+func OpenBidiStream[A, R any](ctx context.Context, client *Client, serviceMethod string) (*BidiStream[A, R], error) {
+	s, err := client.openStream(ctx, &Call{ServerMethod: serviceMethod, Args: invalidRequest}, newValue[R])
+	if err != nil {
+		return nil, err
+	}
+	return &BidiStream[A, R]{s: s}, nil
+}
+
+// Send 发送一个参数，服务端的接收窗口用完时阻塞；流已经结束时返回 io.EOF，
+// 结束的原因由 Recv 返回。Send 和 CloseSend 不能并发调用
+func (s *BidiStream[A, R]) Send(args A) error {
+	return s.s.send(args)
+}
+
+// CloseSend 半关闭，服务端的 Recv 读完已经发送的参数后返回 io.EOF，之后仍然可以 Recv
+func (s *BidiStream[A, R]) CloseSend() error {
+	return s.s.closeSend()
+}
+
+// Recv 和 Stream.Recv 相同
+func (s *BidiStream[A, R]) Recv() (R, error) {
+	return recvAs[R](s.s)
+}
+
+// Close 放弃调用并通知服务端取消
+func (s *BidiStream[A, R]) Close() error {
+	return s.s.close()
+}
+
+func recvAs[R any](s *clientStream) (R, error) {
+	reply, err := s.recv()
+	if err != nil {
+		var zero R
+		return zero, err
+	}
+	return valueOf[R](reply), nil
+}
+
+// newValue 返回解码一个 R 的目标。R 是指针时和服务端的 newArgv 一样分配它指向的值，
+// 解码到 R 本身，protobuf 的消息只能解码到 *pb.Msg，不能解码到 **pb.Msg
+func newValue[R any]() interface{} {
+	if t := reflect.TypeOf((*R)(nil)).Elem(); t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem()).Interface()
+	}
+	return new(R)
+}
+
+// valueOf 从 newValue 返回的目标中取出 R
+func valueOf[R any](v interface{}) R {
+	if r, ok := v.(*R); ok {
+		return *r
+	}
+	return v.(R)
+}
+
+type clientStream struct {
+	client   *Client
+	call     *Call
+	newReply func() interface{} // 只发送的流为 nil
+	frames   chan interface{}   // 容量为窗口大小，服务端不会发送更多的帧
+	window   uint32
+	consumed uint32 // 还没有还给服务端的窗口
+
+	mu         sync.Mutex // protect following
+	credits    uint32     // 服务端允许发送的参数个数
+	wake       chan struct{}
+	sendClosed bool
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	end       chan struct{} // 流结束时关闭，之后 err 不再改变
+	err       error
+}
+
+// openStream 发送打开流的请求，call 的 Metadata、timeout 和窗口在这里设置
+func (client *Client) openStream(ctx context.Context, call *Call, newReply func() interface{}) (*clientStream, error) {
+	//只发送的流不接收数据帧，窗口只用来表明这是流式调用
+	window := uint32(1)
+	if newReply != nil {
+		window = streamWindow(ctx)
+	}
+	s := &clientStream{
+		client:   client,
+		call:     call,
+		newReply: newReply,
+		frames:   make(chan interface{}, window),
+		window:   window,
+		wake:     make(chan struct{}),
+		closeCh:  make(chan struct{}),
+		end:      make(chan struct{}),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.timeout = time.Until(deadline)
+	}
+	call.Metadata = MetadataFromContext(ctx)
+	call.window = window
+	//发出请求之前设置好 call，receive 可能马上收到流帧
+	call.stream = s
+	client.goCall(call, make(chan *Call, 1))
+	//seq 从 1 开始，为 0 说明没有注册成功，call 已经完成
+	if call.Seq == 0 {
+		<-call.Done
+		return nil, call.Error
+	}
+	go s.watch(ctx)
+	return s, nil
+}
+
+// watch 等待结束帧、ctx 结束或者 Close
+func (s *clientStream) watch(ctx context.Context) {
+	select {
+	case call := <-s.call.Done:
+		setReplyMetadata(ctx, call.ReplyMetadata)
+		s.err = call.Error
+		if s.err == nil {
+			s.err = io.EOF
+		}
+	case <-ctx.Done():
+		s.abort()
+		s.err = errors.New("rpc client: call failed: " + ctx.Err().Error())
+	case <-s.closeCh:
+		s.abort()
+		s.err = ErrStreamClosed
+	}
+	close(s.end)
+}
+
+func (s *clientStream) abort() {
+	if s.client.removeCall(s.call.Seq) != nil {
+		s.client.sendCancel(s.call.Seq, s.call.ServerMethod)
+	}
+}
+
+func (s *clientStream) close() error {
+	s.closeOnce.Do(func() { close(s.closeCh) })
+	return nil
+}
+
+func (s *clientStream) header() *edcode.Header {
+	return &edcode.Header{ServiceMethod: s.call.ServerMethod, Seq: s.call.Seq, Stream: true}
+}
+
+func (s *clientStream) send(args interface{}) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	return s.client.writeFrame(s.header(), args)
+}
+
+// acquire 等待并消耗一个窗口，等待时不持有 sending，不影响同一个连接上的其他调用
+func (s *clientStream) acquire() error {
+	for {
+		s.mu.Lock()
+		if s.sendClosed {
+			s.mu.Unlock()
+			return ErrStreamClosed
+		}
+		select {
+		case <-s.end:
+			s.mu.Unlock()
+			return io.EOF
+		default:
+		}
+		if s.credits > 0 {
+			s.credits--
+			s.mu.Unlock()
+			return nil
+		}
+		wake := s.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-s.end:
+		}
+	}
+}
+
+// grant 服务端读完了 n 个参数，允许再发送 n 个
+func (s *clientStream) grant(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credits += n
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *clientStream) closeSend() error {
+	s.mu.Lock()
+	closed := s.sendClosed
+	s.sendClosed = true
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+	select {
+	case <-s.end:
+		return nil
+	default:
+	}
+	h := s.header()
+	h.EndStream = true
+	return s.client.writeFrame(h, invalidRequest)
+}
+
+func (s *clientStream) recv() (interface{}, error) {
+	select {
+	case reply := <-s.frames:
+		return s.take(reply), nil
+	default:
+	}
+	select {
+	case reply := <-s.frames:
+		return s.take(reply), nil
+	case <-s.end:
+		//结束帧之前的数据帧已经在 frames 里了
+		select {
+		case reply := <-s.frames:
+			return s.take(reply), nil
+		default:
+			return nil, s.err
+		}
+	}
+}
+
+// take 每读完半个窗口的帧，把这些窗口还给服务端
+func (s *clientStream) take(reply interface{}) interface{} {
+	s.consumed++
+	if s.consumed >= (s.window+1)/2 {
+		select {
+		case <-s.end:
+		default:
+			h := s.header()
+			h.Window = s.consumed
+			s.client.sendControl(h)
+		}
+		s.consumed = 0
+	}
+	return reply
+}
+
+// frame 在 receive 中处理服务端发来的流帧，不会阻塞；返回的错误会关闭连接
+func (s *clientStream) frame(h *edcode.Header) error {
+	if h.Window > 0 {
+		s.grant(h.Window)
+		return s.client.c.ReadBody(nil)
+	}
+	if s.newReply == nil {
+		_ = s.client.c.ReadBody(nil)
+		s.fail(errUnexpectedFrame)
+		return nil
+	}
+	reply := s.newReply()
+	if err := s.client.c.ReadBody(reply); err != nil {
+		if !errors.Is(err, edcode.ErrBodyType) {
+			return err
+		}
+		// the body has been consumed, keep the connection
+		s.fail(errors.New("reading body " + err.Error()))
+		return nil
+	}
+	select {
+	case s.frames <- reply:
+	default:
+		s.fail(errStreamWindowExceeded)
+	}
+	return nil
+}
+
+// fail 以 err 结束流并通知服务端取消
+func (s *clientStream) fail(err error) {
+	call := s.client.removeCall(s.call.Seq)
+	if call == nil {
+		return
+	}
+	log.Println("rpc client: stream error:", err)
+	call.Error = err
+	call.done()
+	go s.client.sendCancel(call.Seq, call.ServerMethod)
+}
+
+// deliverStream 把流帧交给对应的流，流已经结束时丢弃
+func (client *Client) deliverStream(h *edcode.Header) error {
+	client.mu.Lock()
+	call := client.pending[h.Seq]
+	client.mu.Unlock()
+	if call == nil || call.stream == nil {
+		return client.c.ReadBody(nil)
+	}
+	return call.stream.frame(h)
+}
@@ -0,0 +1,135 @@
+package edcode
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// BodyEncoder 把 body 单独编码成字节，不带 header，用于把 body 嵌在另一个 body 里，如压缩和批量调用。
+// 同一个 BodyEncoder 编码的字节要按顺序交给同一个 BodyDecoder，gob 的类型信息只在第一次出现时编码
+type BodyEncoder interface {
+	Encode(body interface{}) ([]byte, error)
+}
+
+// BodyDecoder body 为 nil 时丢弃，但仍然要按顺序调用，gob 需要读到其中的类型信息
+type BodyDecoder interface {
+	Decode(data []byte, body interface{}) error
+}
+
+func NewBodyEncoder(codecType Type) (BodyEncoder, error) {
+	switch codecType {
+	case GobType:
+		g := &gobBodyEncoder{}
+		g.enc = gob.NewEncoder(&g.buf)
+		return g, nil
+	case JsonType:
+		return jsonBody{}, nil
+	case MsgpackType:
+		return msgpackBody{}, nil
+	case ProtobufType:
+		return protobufBody{}, nil
+	}
+	return nil, fmt.Errorf("invalid codec type %s", codecType)
+}
+
+func NewBodyDecoder(codecType Type) (BodyDecoder, error) {
+	switch codecType {
+	case GobType:
+		g := &gobBodyDecoder{}
+		g.dec = gob.NewDecoder(&g.buf)
+		return g, nil
+	case JsonType:
+		return jsonBody{}, nil
+	case MsgpackType:
+		return msgpackBody{}, nil
+	case ProtobufType:
+		return protobufBody{}, nil
+	}
+	return nil, fmt.Errorf("invalid codec type %s", codecType)
+}
+
+type gobBodyEncoder struct {
+	buf bytes.Buffer
+	enc *gob.Encoder
+}
+
+func (g *gobBodyEncoder) Encode(body interface{}) ([]byte, error) {
+	//编码失败时已经写出的类型信息留在 buf 里，随下一个 body 一起返回
+	if err := g.enc.Encode(body); err != nil {
+		return nil, err
+	}
+	data := append([]byte(nil), g.buf.Bytes()...)
+	g.buf.Reset()
+	return data, nil
+}
+
+type gobBodyDecoder struct {
+	buf bytes.Buffer
+	dec *gob.Decoder
+}
+
+func (g *gobBodyDecoder) Decode(data []byte, body interface{}) error {
+	g.buf.Reset()
+	g.buf.Write(data)
+	return g.dec.Decode(body)
+}
+
+type jsonBody struct{}
+
+func (jsonBody) Encode(body interface{}) ([]byte, error) {
+	return json.Marshal(body)
+}
+
+func (jsonBody) Decode(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return json.Unmarshal(data, body)
+}
+
+type msgpackBody struct{}
+
+func (msgpackBody) Encode(body interface{}) ([]byte, error) {
+	return msgpack.Marshal(body)
+}
+
+func (msgpackBody) Decode(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return msgpack.Unmarshal(data, body)
+}
+
+// protobufBody 和 ProtobufCodec 一样只支持 proto.Message 和原样传递的 []byte
+type protobufBody struct{}
+
+func (protobufBody) Encode(body interface{}) ([]byte, error) {
+	if raw, ok := body.([]byte); ok {
+		return raw, nil
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return nil, bodyTypeError(ProtobufType, body, "proto.Message")
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufBody) Decode(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	if raw, ok := body.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return bodyTypeError(ProtobufType, body, "proto.Message")
+	}
+	return proto.Unmarshal(data, msg)
+}
@@ -1,12 +1,26 @@
 package edcode
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Header 表明了消息体里的信息，和自身信息
 type Header struct {
 	ServiceMethod string // format "Service.Method",请求方法
 	Seq           uint64 // sequence number chosen by client
 	Error         string
+	Timeout       time.Duration     // 客户端剩余的等待时间，0 表示没有限制
+	Cancel        bool              // 客户端放弃了 Seq 对应的请求，body 为空
+	Metadata      map[string]string // 请求或响应携带的元数据，如鉴权、链路追踪信息
+	Compressed    bool              // body 是否被压缩，见 CompressCodec
+	Encoded       bool              // body 是 BodyEncoder 单独编码好的字节，没有压缩，见 CompressCodec
+	GoAway        bool              // 服务端即将关闭，客户端不要再发送新的请求，body 为空
+	Stream        bool              // 属于 Seq 对应的流的帧，见 rpcserver.ServerStream
+	Window        uint32            // 接收方允许对方再发送的流帧数，请求中为初始窗口
+	EndStream     bool              // 发送方不再发送 Seq 对应的流的数据帧（半关闭），body 为空；请求中表示参数就是全部的数据
+	OneWay        bool              // 单向请求，服务端执行后不回复，出错也不回复
+	Batch         bool              // 批量调用，body 为 rpcserver.BatchRequest 或 rpcserver.BatchReply
 }
 type Codec interface {
 	io.Closer
@@ -22,7 +36,12 @@ type NewCodecFunc func(conn io.ReadWriteCloser) Codec
 
 type Type string
 
-const GobType Type = "application/gob"
+const (
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	ProtobufType Type = "application/protobuf"
+	MsgpackType  Type = "application/msgpack"
+)
 
 var NewCodecFuncMap map[Type]NewCodecFunc
 
@@ -30,4 +49,7 @@ var NewCodecFuncMap map[Type]NewCodecFunc
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGob
+	NewCodecFuncMap[JsonType] = NewJson
+	NewCodecFuncMap[ProtobufType] = NewProtobuf
+	NewCodecFuncMap[MsgpackType] = NewMsgpack
 }
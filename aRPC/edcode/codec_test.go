@@ -0,0 +1,173 @@
+package edcode
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (b *bufferConn) Close() error { return nil }
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+type Args struct{ Num1, Num2 int }
+
+// 每种编解码方式写入和读出的 body，protobuf 只支持 proto.Message
+func newBodies(codecType Type) (write, read interface{}, check func() bool) {
+	if codecType == ProtobufType {
+		reply := &wrapperspb.StringValue{}
+		return wrapperspb.String("hello"), reply, func() bool { return reply.Value == "hello" }
+	}
+	args := &Args{}
+	return &Args{Num1: 3, Num2: 4}, args, func() bool { return args.Num1 == 3 && args.Num2 == 4 }
+}
+
+// 每种编解码方式都要能跳过不需要的 body，继续读下一个 header
+func TestCodec_ReadBodyNil(t *testing.T) {
+	for codecType, f := range NewCodecFuncMap {
+		conn := &bufferConn{}
+		c := f(conn)
+		write, read, check := newBodies(codecType)
+		_ = c.WriteHeaderAndBody(&Header{ServiceMethod: "Foo.Sum", Seq: 1, Timeout: time.Second}, write)
+		_ = c.WriteHeaderAndBody(&Header{ServiceMethod: "Foo.Sum", Seq: 2, Metadata: map[string]string{"k": "v"}}, write)
+		_ = c.WriteHeaderAndBody(&Header{Seq: 3, Error: "failed", Cancel: true, GoAway: true, Stream: true, Window: 16, EndStream: true, OneWay: true, Batch: true, Encoded: true}, struct{}{})
+
+		var h Header
+		err := c.ReadHeader(&h)
+		_assert(err == nil && h.Seq == 1 && h.Timeout == time.Second, "%s: read header error: %v", codecType, err)
+		_assert(c.ReadBody(nil) == nil, "%s: discard body error", codecType)
+		err = c.ReadHeader(&h)
+		_assert(err == nil && h.Seq == 2 && h.Metadata["k"] == "v", "%s: read second header error: %v", codecType, err)
+		err = c.ReadBody(read)
+		_assert(err == nil && check(), "%s: read body error: %v", codecType, err)
+		err = c.ReadHeader(&h)
+		_assert(err == nil && h.Seq == 3 && h.Error == "failed" && h.Cancel && h.GoAway && h.Stream && h.Window == 16 && h.EndStream && h.OneWay && h.Batch && h.Encoded, "%s: read third header error: %v", codecType, err)
+		_assert(c.ReadBody(nil) == nil, "%s: discard placeholder error", codecType)
+	}
+}
+
+func TestProtobufCodec_BodyType(t *testing.T) {
+	conn := &bufferConn{}
+	c := NewProtobuf(conn)
+	err := c.WriteHeaderAndBody(&Header{Seq: 1}, &Args{Num1: 1})
+	_assert(errors.Is(err, ErrBodyType) && conn.Len() == 0, "expect ErrBodyType before writing, got %v", err)
+
+	_ = c.WriteHeaderAndBody(&Header{Seq: 1}, wrapperspb.Int64(1))
+	_ = c.WriteHeaderAndBody(&Header{Seq: 2}, wrapperspb.Int64(2))
+	var h Header
+	_ = c.ReadHeader(&h)
+	err = c.ReadBody(&Args{})
+	_assert(errors.Is(err, ErrBodyType), "expect ErrBodyType, got %v", err)
+	// the frame has been consumed, the next header is still readable
+	err = c.ReadHeader(&h)
+	reply := &wrapperspb.Int64Value{}
+	_assert(err == nil && h.Seq == 2 && c.ReadBody(reply) == nil && reply.Value == 2, "expect stream kept in sync")
+}
+
+func TestCompressCodec(t *testing.T) {
+	for codecType, f := range NewCodecFuncMap {
+		for compression := range CompressorMap {
+			conn := &bufferConn{}
+			c, err := WithCompression(f(conn), codecType, compression, 512)
+			_assert(err == nil, "%s: with compression error: %v", compression, err)
+			// 请求方向的 body 很小，不压缩；响应方向的 body 很大，需要压缩
+			small := wrapperspb.String("hi")
+			large := wrapperspb.String(strings.Repeat("aRPC", 1024))
+			_ = c.WriteHeaderAndBody(&Header{Seq: 1}, small)
+			_ = c.WriteHeaderAndBody(&Header{Seq: 2}, large)
+			_ = c.WriteHeaderAndBody(&Header{Seq: 3}, large)
+			_assert(conn.Len() < 4096, "%s/%s: expect large bodies compressed, got %d bytes", codecType, compression, conn.Len())
+
+			var h Header
+			reply := &wrapperspb.StringValue{}
+			_ = c.ReadHeader(&h)
+			err = c.ReadBody(reply)
+			_assert(err == nil && !h.Compressed && reply.Value == "hi", "%s/%s: read small body error: %v", codecType, compression, err)
+			_ = c.ReadHeader(&h)
+			_assert(h.Compressed && c.ReadBody(nil) == nil, "%s/%s: discard compressed body error", codecType, compression)
+			_ = c.ReadHeader(&h)
+			err = c.ReadBody(reply)
+			_assert(err == nil && h.Seq == 3 && reply.Value == large.Value, "%s/%s: read large body error: %v", codecType, compression, err)
+		}
+	}
+	_, err := WithCompression(NewGob(&bufferConn{}), GobType, "lz4", 0)
+	_assert(err != nil, "expect invalid compression error")
+}
+
+// countingBody 记录被编码的次数
+type countingBody struct {
+	Value string
+	count *int
+}
+
+func (b countingBody) MarshalJSON() ([]byte, error) {
+	*b.count++
+	return json.Marshal(b.Value)
+}
+
+func TestCompressCodec_EncodeOnce(t *testing.T) {
+	conn := &bufferConn{}
+	c, _ := WithCompression(NewJson(conn), JsonType, CompressGzip, 512)
+	var count int
+	_ = c.WriteHeaderAndBody(&Header{Seq: 1}, countingBody{Value: "hi", count: &count})
+	_assert(count == 1, "expect a small body encoded once, got %d", count)
+	var h Header
+	var reply string
+	_ = c.ReadHeader(&h)
+	err := c.ReadBody(&reply)
+	_assert(err == nil && h.Encoded && !h.Compressed && reply == "hi", "read small body error: %v", err)
+}
+
+// gob 的类型信息只随第一个 body 发送，丢弃的 body 也要交给解码器
+func TestCompressCodec_GobTypeOnce(t *testing.T) {
+	conn := &bufferConn{}
+	c, _ := WithCompression(NewGob(conn), GobType, CompressSnappy, 512)
+	_ = c.WriteHeaderAndBody(&Header{Seq: 1}, &Args{Num1: 1, Num2: 2})
+	first := conn.Len()
+	_ = c.WriteHeaderAndBody(&Header{Seq: 2}, &Args{Num1: 3, Num2: 4})
+	_assert(conn.Len()-first < first, "expect the type sent once, got %d then %d bytes", first, conn.Len()-first)
+
+	var h Header
+	args := &Args{}
+	_ = c.ReadHeader(&h)
+	_assert(c.ReadBody(nil) == nil, "discard body error")
+	_ = c.ReadHeader(&h)
+	err := c.ReadBody(args)
+	_assert(err == nil && h.Seq == 2 && args.Num1 == 3 && args.Num2 == 4, "read body after discarding error: %v", err)
+}
+
+func TestBodyEncoder(t *testing.T) {
+	for codecType := range NewCodecFuncMap {
+		enc, err := NewBodyEncoder(codecType)
+		_assert(err == nil, "%s: new body encoder error: %v", codecType, err)
+		dec, _ := NewBodyDecoder(codecType)
+		write, read, check := newBodies(codecType)
+		first, err := enc.Encode(write)
+		_assert(err == nil, "%s: encode error: %v", codecType, err)
+		second, _ := enc.Encode(write)
+		_assert(len(second) <= len(first), "%s: expect the type encoded once", codecType)
+		// the first body is discarded, the second one still decodes
+		_assert(dec.Decode(first, nil) == nil, "%s: discard error", codecType)
+		err = dec.Decode(second, read)
+		_assert(err == nil && check(), "%s: decode error: %v", codecType, err)
+	}
+	enc, _ := NewBodyEncoder(ProtobufType)
+	_, err := enc.Encode(&Args{})
+	_assert(errors.Is(err, ErrBodyType), "expect ErrBodyType, got %v", err)
+	_, err = NewBodyEncoder("application/xml")
+	_assert(err != nil, "expect invalid codec type")
+}
@@ -0,0 +1,205 @@
+package edcode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression 压缩算法，由 Option 协商，空字符串表示不压缩
+type Compression string
+
+const (
+	CompressNone   Compression = ""
+	CompressGzip   Compression = "gzip"
+	CompressSnappy Compression = "snappy"
+	CompressZstd   Compression = "zstd"
+)
+
+// DefaultCompressThreshold body 编码后不小于这个字节数才压缩
+const DefaultCompressThreshold = 1024
+
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+/*给压缩算法也实现一个注册表*/
+var CompressorMap map[Compression]Compressor
+
+func init() {
+	CompressorMap = make(map[Compression]Compressor)
+	CompressorMap[CompressGzip] = gzipCompressor{}
+	CompressorMap[CompressSnappy] = snappyCompressor{}
+	CompressorMap[CompressZstd] = newZstdCompressor()
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return io.ReadAll(r)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// zstd 的编码器和解码器创建开销较大，所有连接共用一份，EncodeAll/DecodeAll 可以并发调用
+type zstdCompressor struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error // 创建编码器或者解码器的错误
+}
+
+func newZstdCompressor() *zstdCompressor {
+	return &zstdCompressor{}
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		if z.enc, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.dec, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(data, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(data, nil)
+}
+
+// CompressCodec 包装任意一个 Codec：body 先用同类型的 BodyEncoder 单独编码成字节，
+// 超过阈值时压缩后发送，并在 header 中标记 Compressed；小的 body 不压缩，
+// 编码好的字节直接发送，并在 header 中标记 Encoded。占位符直接交给被包装的 Codec。
+// 每个方向的 body 共用一个 BodyEncoder/BodyDecoder，gob 的类型信息只发送一次
+type CompressCodec struct {
+	Codec
+	enc        BodyEncoder
+	dec        BodyDecoder
+	compressor Compressor
+	threshold  int
+	encoded    bool // 最近一次读到的 header 是否标记了 Encoded
+	compressed bool // 最近一次读到的 header 是否标记了 Compressed
+}
+
+var _ Codec = (*CompressCodec)(nil)
+
+// WithCompression compression 为空时直接返回 c，threshold 为 0 时使用 DefaultCompressThreshold
+func WithCompression(c Codec, codecType Type, compression Compression, threshold int) (Codec, error) {
+	if compression == CompressNone {
+		return c, nil
+	}
+	compressor := CompressorMap[compression]
+	if compressor == nil {
+		return nil, fmt.Errorf("rpc codec: invalid compression %s", compression)
+	}
+	//需要初始化的压缩算法在这里报告错误
+	if z, ok := compressor.(interface{ init() error }); ok {
+		if err := z.init(); err != nil {
+			return nil, fmt.Errorf("rpc codec: init compression %s: %w", compression, err)
+		}
+	}
+	enc, err := NewBodyEncoder(codecType)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := NewBodyDecoder(codecType)
+	if err != nil {
+		return nil, err
+	}
+	if threshold == 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return &CompressCodec{
+		Codec:      c,
+		enc:        enc,
+		dec:        dec,
+		compressor: compressor,
+		threshold:  threshold,
+	}, nil
+}
+
+func (c *CompressCodec) ReadHeader(header *Header) error {
+	err := c.Codec.ReadHeader(header)
+	c.encoded = err == nil && header.Encoded
+	c.compressed = err == nil && header.Compressed
+	return err
+}
+
+func (c *CompressCodec) ReadBody(body interface{}) error {
+	if !c.encoded && !c.compressed {
+		return c.Codec.ReadBody(body)
+	}
+	var data []byte
+	if err := c.Codec.ReadBody(&data); err != nil {
+		return err
+	}
+	if c.compressed {
+		var err error
+		if data, err = c.compressor.Decompress(data); err != nil {
+			return err
+		}
+	}
+	//body 为 nil 时也要交给解码器，gob 需要其中的类型信息
+	return c.dec.Decode(data, body)
+}
+
+func (c *CompressCodec) WriteHeaderAndBody(header *Header, body interface{}) error {
+	if isPlaceholder(body) {
+		return c.Codec.WriteHeaderAndBody(header, body)
+	}
+	data, err := c.enc.Encode(body)
+	if err != nil {
+		return err
+	}
+	h := *header
+	if len(data) < c.threshold {
+		h.Encoded = true
+		return c.Codec.WriteHeaderAndBody(&h, data)
+	}
+	if data, err = c.compressor.Compress(data); err != nil {
+		return err
+	}
+	h.Compressed = true
+	return c.Codec.WriteHeaderAndBody(&h, data)
+}
@@ -0,0 +1,86 @@
+package edcode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 长度前缀的帧：| length(4 字节, 大端) | data |
+// 读的一方不需要解析 data 就能跳过整个帧
+
+const maxFrameSize = 1 << 30
+
+var ErrFrameTooLarge = errors.New("rpc codec: frame too large")
+
+// ErrBodyType body 的类型不被编解码器支持。
+// 返回这个错误时报文已经完整读出，或者还没有写入，连接仍然可以继续使用
+var ErrBodyType = errors.New("rpc codec: unsupported body type")
+
+func bodyTypeError(codec Type, body interface{}, expect string) error {
+	return fmt.Errorf("%w: %s expects %s, got %T", ErrBodyType, codec, expect, body)
+}
+
+func writeFrame(w *bufio.Writer, data []byte) error {
+	if len(data) > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrameSize(r *bufio.Reader) (int, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	return int(n), nil
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	n, err := readFrameSize(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err = io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// 不需要的帧直接丢弃，不用解码
+func skipFrame(r *bufio.Reader) error {
+	n, err := readFrameSize(r)
+	if err != nil {
+		return err
+	}
+	_, err = r.Discard(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// 错误回复和取消帧的 body 只是占位符，不需要编码
+func isPlaceholder(body interface{}) bool {
+	if body == nil {
+		return true
+	}
+	_, ok := body.(struct{})
+	return ok
+}
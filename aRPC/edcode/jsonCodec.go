@@ -0,0 +1,64 @@
+package edcode
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// JsonCodec 使用 JSON 编解码 header 和 body，方便非 Go 的调用方接入，
+// 抓包时也可以直接看到内容。header 和 body 依次作为两个 JSON 值写入连接
+type JsonCodec struct {
+	conn   io.ReadWriteCloser
+	buf    *bufio.Writer
+	decode *json.Decoder
+	encode *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func NewJson(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn:   conn,
+		buf:    buf,
+		decode: json.NewDecoder(conn),
+		encode: json.NewEncoder(buf),
+	}
+}
+
+func (j *JsonCodec) Close() error {
+	return j.conn.Close()
+}
+
+func (j *JsonCodec) ReadHeader(header *Header) error {
+	return j.decode.Decode(header)
+}
+
+// ReadBody body 为 nil 时读出一个完整的 JSON 值并丢弃
+func (j *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		var discard json.RawMessage
+		return j.decode.Decode(&discard)
+	}
+	return j.decode.Decode(body)
+}
+
+func (j *JsonCodec) WriteHeaderAndBody(header *Header, body interface{}) (err error) {
+	defer func() {
+		_ = j.buf.Flush()
+		if err != nil {
+			_ = j.Close()
+		}
+	}()
+	if err = j.encode.Encode(header); err != nil {
+		log.Println("rpc codec: json error encoding header:", err)
+		return err
+	}
+	if err = j.encode.Encode(body); err != nil {
+		log.Println("rpc codec: json error encoding body:", err)
+		return err
+	}
+	return nil
+}
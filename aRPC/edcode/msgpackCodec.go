@@ -0,0 +1,81 @@
+package edcode
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec header 和 body 分别用 MessagePack 编码后作为一个长度前缀的帧写入，
+// ReadBody(nil) 根据长度直接跳过整个帧，不需要解码
+type MsgpackCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	r    *bufio.Reader
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+
+func NewMsgpack(conn io.ReadWriteCloser) Codec {
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (m *MsgpackCodec) Close() error {
+	return m.conn.Close()
+}
+
+func (m *MsgpackCodec) ReadHeader(header *Header) error {
+	data, err := readFrame(m.r)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(data, header)
+}
+
+func (m *MsgpackCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return skipFrame(m.r)
+	}
+	data, err := readFrame(m.r)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(data, body)
+}
+
+func (m *MsgpackCodec) WriteHeaderAndBody(header *Header, body interface{}) (err error) {
+	//先编码好再写，编码失败时连接上什么都没有写
+	h, err := msgpack.Marshal(header)
+	if err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	var data []byte
+	if !isPlaceholder(body) {
+		if data, err = msgpack.Marshal(body); err != nil {
+			log.Println("rpc codec: msgpack error encoding body:", err)
+			return err
+		}
+	}
+	defer func() {
+		_ = m.buf.Flush()
+		if err != nil {
+			_ = m.Close()
+		}
+	}()
+	if err = writeFrame(m.buf, h); err != nil {
+		log.Println("rpc codec: msgpack error writing header:", err)
+		return err
+	}
+	if err = writeFrame(m.buf, data); err != nil {
+		log.Println("rpc codec: msgpack error writing body:", err)
+		return err
+	}
+	return nil
+}
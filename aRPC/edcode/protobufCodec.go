@@ -0,0 +1,284 @@
+package edcode
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec header 和 body 分别作为一个长度前缀的帧写入，
+// body 必须实现 proto.Message，header 按下面的 .proto 定义手工编码：
+//
+//	message Header {
+//	  string service_method = 1;
+//	  uint64 seq = 2;
+//	  string error = 3;
+//	  int64 timeout = 4; // nanoseconds
+//	  bool cancel = 5;
+//	  map<string, string> metadata = 6;
+//	  bool compressed = 7;
+//	  bool go_away = 8;
+//	  bool stream = 9;
+//	  uint32 window = 10;
+//	  bool end_stream = 11;
+//	  bool one_way = 12;
+//	  bool batch = 13;
+//	  bool encoded = 14;
+//	}
+//
+// []byte 类型的 body 作为已经编码好的数据原样写入和读出
+type ProtobufCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	r    *bufio.Reader
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+
+func NewProtobuf(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (p *ProtobufCodec) Close() error {
+	return p.conn.Close()
+}
+
+func (p *ProtobufCodec) ReadHeader(header *Header) error {
+	data, err := readFrame(p.r)
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(data, header)
+}
+
+// ReadBody 先读出整个帧，body 不是 proto.Message 时返回 ErrBodyType，连接仍然可用
+func (p *ProtobufCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return skipFrame(p.r)
+	}
+	data, err := readFrame(p.r)
+	if err != nil {
+		return err
+	}
+	if raw, ok := body.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return bodyTypeError(ProtobufType, body, "proto.Message")
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+func (p *ProtobufCodec) WriteHeaderAndBody(header *Header, body interface{}) (err error) {
+	//先检查 body 的类型，出错时什么都没写，不需要关闭连接
+	var data []byte
+	if raw, ok := body.([]byte); ok {
+		data = raw
+	} else if !isPlaceholder(body) {
+		msg, ok := body.(proto.Message)
+		if !ok {
+			return bodyTypeError(ProtobufType, body, "proto.Message")
+		}
+		if data, err = proto.Marshal(msg); err != nil {
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return err
+		}
+	}
+	defer func() {
+		_ = p.buf.Flush()
+		if err != nil {
+			_ = p.Close()
+		}
+	}()
+	if err = writeFrame(p.buf, marshalHeader(header)); err != nil {
+		log.Println("rpc codec: protobuf error encoding header:", err)
+		return err
+	}
+	if err = writeFrame(p.buf, data); err != nil {
+		log.Println("rpc codec: protobuf error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func marshalHeader(h *Header) []byte {
+	var b []byte
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Cancel {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.Compressed {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.GoAway {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.Stream {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.Window != 0 {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Window))
+	}
+	if h.EndStream {
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.OneWay {
+		b = protowire.AppendTag(b, 12, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.Batch {
+		b = protowire.AppendTag(b, 13, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if h.Encoded {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	for k, v := range h.Metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+var errBadHeader = errors.New("rpc codec: protobuf malformed header")
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBadHeader
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == 3 && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == 4 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == 5 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Cancel = protowire.DecodeBool(v)
+		case num == 6 && typ == protowire.BytesType:
+			var entry []byte
+			entry, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := unmarshalMetadataEntry(entry, h); err != nil {
+					return err
+				}
+			}
+		case num == 7 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Compressed = protowire.DecodeBool(v)
+		case num == 8 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.GoAway = protowire.DecodeBool(v)
+		case num == 9 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Stream = protowire.DecodeBool(v)
+		case num == 10 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Window = uint32(v)
+		case num == 11 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.EndStream = protowire.DecodeBool(v)
+		case num == 12 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.OneWay = protowire.DecodeBool(v)
+		case num == 13 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Batch = protowire.DecodeBool(v)
+		case num == 14 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Encoded = protowire.DecodeBool(v)
+		default:
+			// unknown field, skip it for forward compatibility
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errBadHeader
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func unmarshalMetadataEntry(b []byte, h *Header) error {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBadHeader
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errBadHeader
+		}
+		b = b[n:]
+	}
+	if h.Metadata == nil {
+		h.Metadata = make(map[string]string)
+	}
+	h.Metadata[key] = value
+	return nil
+}
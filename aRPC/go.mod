@@ -1,3 +1,11 @@
 module aRPC
 
 go 1.21
+
+require (
+	github.com/klauspost/compress v1.17.9
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.34.2
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
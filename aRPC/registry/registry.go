@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry 是一个简单的注册中心，提供以下功能：
+// 添加服务实例并接收心跳以保持其存活；
+// 返回所有存活的服务实例，并同步删除已超时的实例。
+// 服务实例的地址格式与 client.XDial 一致：protocol@addr
+type Registry struct {
+	timeout time.Duration // 0 means no limit
+	mu      sync.Mutex    // protect following
+	servers map[string]*ServerItem
+}
+
+type ServerItem struct {
+	Addr  string
+	start time.Time //最近一次心跳的时间
+}
+
+const (
+	defaultPath           = "/_geerpc_/registry"
+	defaultTimeout        = time.Minute * 5
+	defaultRequestTimeout = time.Second * 5 //心跳和下线请求的超时时间
+)
+
+// httpClient 发送心跳和下线请求，注册中心没有响应时不会一直阻塞
+var httpClient = &http.Client{Timeout: defaultRequestTimeout}
+
+// 注册中心与服务实例、客户端之间通过这两个 HTTP 头交换地址
+const (
+	serverHeader  = "X-Geerpc-Server"
+	serversHeader = "X-Geerpc-Servers"
+)
+
+// New create a registry instance with timeout setting
+func New(timeout time.Duration) *Registry {
+	return &Registry{
+		servers: make(map[string]*ServerItem),
+		timeout: timeout,
+	}
+}
+
+var DefaultRegister = New(defaultTimeout)
+
+// 添加服务实例，如果服务已经存在，则更新 start
+func (r *Registry) putServer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.servers[addr]
+	if s == nil {
+		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+	} else {
+		s.start = time.Now() // if exists, update start time to keep alive
+	}
+}
+
+// 服务实例主动下线
+func (r *Registry) removeServer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.servers, addr)
+}
+
+// 返回可用的服务列表，如果存在超时的服务，则删除
+func (r *Registry) aliveServers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var alive []string
+	for addr, s := range r.servers {
+		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
+			alive = append(alive, addr)
+		} else {
+			delete(r.servers, addr)
+		}
+	}
+	sort.Strings(alive)
+	return alive
+}
+
+// ServeHTTP Runs at /_geerpc_/registry
+// GET 返回所有可用的服务列表，通过自定义字段 X-Geerpc-Servers 承载；
+// POST 添加服务实例或发送心跳，通过自定义字段 X-Geerpc-Server 承载；
+// DELETE 删除服务实例，同样使用 X-Geerpc-Server。
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		// keep it simple, server is in req.Header
+		w.Header().Set(serversHeader, strings.Join(r.aliveServers(), ","))
+	case "POST":
+		addr := req.Header.Get(serverHeader)
+		if addr == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.putServer(addr)
+	case "DELETE":
+		addr := req.Header.Get(serverHeader)
+		if addr == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.removeServer(addr)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleHTTP registers an HTTP handler for Registry messages on registryPath
+func (r *Registry) HandleHTTP(registryPath string) {
+	http.Handle(registryPath, r)
+	log.Println("rpc registry path:", registryPath)
+}
+
+// HandleHTTP 在默认路径上启动默认的注册中心
+func HandleHTTP() {
+	DefaultRegister.HandleHTTP(defaultPath)
+}
+
+// Heartbeat 服务启动时先注册一次，之后每隔 duration 发送一次心跳，直到 ctx 结束；
+// ctx 结束时会通知注册中心将该实例下线。首次注册失败会直接返回错误。
+// registry 为注册中心的完整地址，如 http://localhost:9999/_geerpc_/registry
+func Heartbeat(ctx context.Context, registry, addr string, duration time.Duration) error {
+	if duration == 0 {
+		// make sure there is enough time to send heart beat
+		// before it's removed from registry
+		duration = defaultTimeout - time.Duration(1)*time.Minute
+	}
+	if err := sendHeartbeat(registry, addr); err != nil {
+		return err
+	}
+	go func() {
+		t := time.NewTicker(duration)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				_ = sendRequest("DELETE", registry, addr)
+				return
+			case <-t.C:
+				//注册中心短暂不可用时不退出，下一次心跳会重新注册
+				_ = sendHeartbeat(registry, addr)
+			}
+		}
+	}()
+	return nil
+}
+
+func sendHeartbeat(registry, addr string) error {
+	log.Println(addr, "send heart beat to registry", registry)
+	if err := sendRequest("POST", registry, addr); err != nil {
+		log.Println("rpc server: heart beat err:", err)
+		return err
+	}
+	return nil
+}
+
+func sendRequest(method, registry, addr string) error {
+	req, err := http.NewRequest(method, registry, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(serverHeader, addr)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("rpc registry: unexpected status " + resp.Status)
+	}
+	return nil
+}
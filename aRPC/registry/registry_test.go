@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func getServers(url string) string {
+	resp, err := http.Get(url)
+	_assert(err == nil, "get servers error: %v", err)
+	_ = resp.Body.Close()
+	return resp.Header.Get(serversHeader)
+}
+
+func TestRegistry_Timeout(t *testing.T) {
+	r := New(time.Millisecond * 100)
+	r.putServer("tcp@127.0.0.1:1")
+	r.putServer("http@127.0.0.1:2")
+	_assert(len(r.aliveServers()) == 2, "expect 2 alive servers")
+	time.Sleep(time.Millisecond * 150)
+	r.putServer("http@127.0.0.1:2")
+	alive := r.aliveServers()
+	_assert(len(alive) == 1 && alive[0] == "http@127.0.0.1:2", "expect only refreshed server alive, got %v", alive)
+	_assert(len(r.servers) == 1, "expect dead server removed")
+}
+
+func TestHeartbeat(t *testing.T) {
+	ts := httptest.NewServer(New(time.Second))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := Heartbeat(ctx, ts.URL, "tcp@127.0.0.1:3", time.Millisecond*50)
+	_assert(err == nil, "heartbeat error: %v", err)
+	_assert(getServers(ts.URL) == "tcp@127.0.0.1:3", "expect server registered")
+
+	cancel()
+	time.Sleep(time.Millisecond * 100)
+	_assert(getServers(ts.URL) == "", "expect server removed after shutdown")
+
+	err = Heartbeat(context.Background(), ts.URL, "", time.Second)
+	_assert(err != nil, "expect error for empty addr")
+	resp, err := http.Post(ts.URL, "", nil)
+	_assert(err == nil && resp.StatusCode == http.StatusBadRequest, "expect 400 for a missing server header, got %v", err)
+	_ = resp.Body.Close()
+}
+
+func TestHeartbeat_BadRegistry(t *testing.T) {
+	err := Heartbeat(context.Background(), "http://[::1", "tcp@127.0.0.1:3", time.Second)
+	_assert(err != nil, "expect error for a malformed registry url")
+
+	// a hung registry fails the first heartbeat instead of blocking it
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+	old := httpClient.Timeout
+	httpClient.Timeout = time.Millisecond * 100
+	defer func() { httpClient.Timeout = old }()
+	start := time.Now()
+	err = Heartbeat(context.Background(), ts.URL, "tcp@127.0.0.1:3", time.Second)
+	_assert(err != nil && time.Since(start) < time.Second, "expect heartbeat to time out, got %v after %s", err, time.Since(start))
+}
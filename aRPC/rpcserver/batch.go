@@ -0,0 +1,182 @@
+package rpcserver
+
+import (
+	endecode "aRPC/edcode"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BatchEntry 批量调用中的一个调用，Args 是单独编码的参数。
+// 一个批量请求中的参数共用一个 endecode.BodyEncoder，json 连接上原样嵌入 JSON，其他编码方式为字节
+type BatchEntry struct {
+	ServiceMethod string
+	Args          json.RawMessage
+}
+
+// BatchRequest 批量调用的请求 body，header 中标记了 Batch
+type BatchRequest struct {
+	Entries    []BatchEntry
+	Sequential bool // 按顺序逐个调用，默认并发调用
+}
+
+// BatchResult 一个调用的结果，Error 为空时 Reply 是单独编码的回复，
+// 一个批量回复中的回复和参数一样共用一个 endecode.BodyEncoder
+type BatchResult struct {
+	Reply json.RawMessage
+	Error string
+}
+
+// BatchReply 批量调用的回复 body，Results 和请求的 Entries 一一对应
+type BatchReply struct {
+	Results []BatchResult
+}
+
+// 批量调用的默认限制，见 Server.SetBatchLimit
+const (
+	DefaultMaxBatchSize     = 1024
+	DefaultBatchConcurrency = 16
+)
+
+// SetBatchLimit 设置一个批量调用最多包含的调用数和最多同时执行的调用数，不大于 0 时使用默认值。
+// 超过 maxSize 的批量调用整个回复错误，Sequential 的批量调用总是一个一个执行
+func (server *Server) SetBatchLimit(maxSize, concurrency int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.maxBatchSize = maxSize
+	server.batchConcurrency = concurrency
+}
+
+func (server *Server) batchLimit() (maxSize, concurrency int) {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	maxSize, concurrency = server.maxBatchSize, server.batchConcurrency
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBatchSize
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	return
+}
+
+// handleBatch 调用批量请求中的每个方法，全部完成后用一个回复返回所有的结果。
+// 参数和回复都按 Entries 的顺序解码和编码，gob 的类型信息只出现一次。
+// 每个方法单独受 timeout 限制，请求的元数据和客户端的 Timeout 由所有方法共用，
+// 调用数和并发数受 SetBatchLimit 限制
+func (server *Server) handleBatch(c endecode.Codec, reply *Reply, sending *sync.Mutex, opt *Option) {
+	h := *reply.h
+	entries := reply.batch.Entries
+	maxSize, concurrency := server.batchLimit()
+	dec, err := endecode.NewBodyDecoder(opt.CodeType)
+	if err == nil && len(entries) > maxSize {
+		err = fmt.Errorf("%d calls exceed the limit %d", len(entries), maxSize)
+	}
+	if err != nil {
+		h.Error = "rpc server: batch error: " + err.Error()
+		server.sendRequest(c, &h, invalidRequest, sending)
+		return
+	}
+	enc, _ := endecode.NewBodyEncoder(opt.CodeType)
+	reqs := make([]*Reply, len(entries))
+	results := make([]BatchResult, len(entries))
+	for i := range entries {
+		if reqs[i], err = server.newEntryReply(reply, &entries[i], dec); err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	call := func(i int) {
+		if reqs[i] == nil {
+			return
+		}
+		if err := server.callEntry(reply, reqs[i], opt.HandleTimeout); err != nil {
+			results[i].Error = err.Error()
+			reqs[i] = nil
+		}
+	}
+	if reply.batch.Sequential {
+		for i := range entries {
+			call(i)
+		}
+	} else {
+		//最多同时执行 concurrency 个调用
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+		for i := range entries {
+			if reqs[i] == nil {
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				call(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+	for i, req := range reqs {
+		if req == nil {
+			continue
+		}
+		if results[i].Reply, err = enc.Encode(req.msg.Interface()); err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	h.Metadata = replyMetadataFromContext(reply.ctx)
+	server.sendRequest(c, &h, &BatchReply{Results: results}, sending)
+}
+
+// callEntry 和 Handle 一样，超时或者客户端放弃请求后不再等待方法返回，
+// 这时方法可能还在写 req.msg，不能再使用
+func (server *Server) callEntry(batch *Reply, req *Reply, timeout time.Duration) error {
+	ctx := req.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	called := make(chan error, 1)
+	go func() {
+		called <- server.invoke(ctx, req)
+	}()
+	select {
+	case err := <-called:
+		return err
+	case <-ctx.Done():
+		if batch.ctx.Err() == nil {
+			return fmt.Errorf("rpc server: request handle timeout: expect within %s", timeout)
+		}
+		return errors.New("rpc server: request canceled: " + batch.ctx.Err().Error())
+	}
+}
+
+// newEntryReply 找到 entry 调用的方法并解码参数，批量调用中不能调用流式方法。
+// 出错时参数也要交给 dec，后面的参数可能用到其中 gob 的类型信息
+func (server *Server) newEntryReply(batch *Reply, entry *BatchEntry, dec endecode.BodyDecoder) (*Reply, error) {
+	req := &Reply{
+		h:   &endecode.Header{ServiceMethod: entry.ServiceMethod, Seq: batch.h.Seq},
+		ctx: batch.ctx,
+	}
+	var err error
+	req.svc, req.mtype, err = server.findService(entry.ServiceMethod)
+	if err == nil && !req.mtype.accepts(req.h) {
+		err = fmt.Errorf("rpc server: %s is a %s method", entry.ServiceMethod, req.mtype.streamKind())
+	}
+	if err != nil {
+		_ = dec.Decode(entry.Args, nil)
+		return nil, err
+	}
+	req.argv = req.mtype.newArgv()
+	req.msg = req.mtype.newReply()
+	if err := dec.Decode(entry.Args, argvPointer(req.argv)); err != nil {
+		return nil, fmt.Errorf("rpc server: read argv err: %w", err)
+	}
+	return req, nil
+}
@@ -0,0 +1,122 @@
+package rpcserver
+
+import (
+	endecode "aRPC/edcode"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// 协议版本，客户端在 Option.Version 中带上自己支持的最高版本，
+// 服务端在 [MinProtocolVersion, ProtocolVersion] 中选一个版本应答。
+// Version 为 0 表示不认识握手应答的旧客户端，服务端不回复，直接开始处理报文
+const (
+	MinProtocolVersion = 1
+	ProtocolVersion    = 1
+)
+
+// RejectCode 服务端拒绝 Option 的原因
+type RejectCode int
+
+const (
+	RejectNone RejectCode = iota
+	RejectBadMagic
+	RejectUnknownCodec
+	RejectUnsupportedVersion
+	RejectUnknownCompression
+)
+
+func (code RejectCode) String() string {
+	switch code {
+	case RejectNone:
+		return "accepted"
+	case RejectBadMagic:
+		return "invalid magic number"
+	case RejectUnknownCodec:
+		return "invalid codec type"
+	case RejectUnsupportedVersion:
+		return "unsupported protocol version"
+	case RejectUnknownCompression:
+		return "invalid compression"
+	default:
+		return fmt.Sprintf("reject code %d", int(code))
+	}
+}
+
+// HandshakeAck 服务端收到 Option 后用 JSON 回复的应答：
+// | Option | HandshakeAck | Header1 | Body1 | ...
+// Accepted 为 true 时 Option 是服务端接受的选项，之后的报文按它编解码；
+// 否则 Code 和 Message 说明拒绝的原因，服务端随后关闭连接
+type HandshakeAck struct {
+	Accepted bool
+	Option   Option
+	Code     RejectCode
+	Message  string
+	Version  int // 服务端支持的最高协议版本
+
+	Idempotent []string // 服务端声明的幂等方法 "Service.Method"，见 IdempotentMethods
+}
+
+// 检查客户端的 Option，返回服务端接受的 Option，或者拒绝的应答
+func negotiate(opt *Option) *HandshakeAck {
+	reject := func(code RejectCode, format string, v ...interface{}) *HandshakeAck {
+		return &HandshakeAck{
+			Code:    code,
+			Message: "rpc server: " + fmt.Sprintf(format, v...),
+			Version: ProtocolVersion,
+		}
+	}
+	if opt.MagicInt != MagicData {
+		return reject(RejectBadMagic, "invalid magic number %x", opt.MagicInt)
+	}
+	if endecode.NewCodecFuncMap[opt.CodeType] == nil {
+		return reject(RejectUnknownCodec, "invalid codec type %s", opt.CodeType)
+	}
+	if opt.Compression != endecode.CompressNone && endecode.CompressorMap[opt.Compression] == nil {
+		return reject(RejectUnknownCompression, "invalid compression %s", opt.Compression)
+	}
+	accepted := *opt
+	if accepted.StreamWindow < 0 {
+		accepted.StreamWindow = 0
+	}
+	if accepted.StreamWindow > MaxStreamWindow {
+		accepted.StreamWindow = MaxStreamWindow //客户端不能让服务端为一个流缓存太多参数
+	}
+	if opt.Version != 0 {
+		if opt.Version < MinProtocolVersion {
+			return reject(RejectUnsupportedVersion, "unsupported protocol version %d, expect %d to %d",
+				opt.Version, MinProtocolVersion, ProtocolVersion)
+		}
+		if accepted.Version > ProtocolVersion {
+			accepted.Version = ProtocolVersion //客户端更新，降级到服务端支持的版本
+		}
+	}
+	return &HandshakeAck{Accepted: true, Option: accepted, Version: ProtocolVersion}
+}
+
+// 不带换行符写入应答，客户端读完应答后连接里不会残留多余的字节
+func writeHandshakeAck(conn io.Writer, ack *HandshakeAck) error {
+	data, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// 所有服务声明的幂等方法，按名字排序
+func (server *Server) idempotentMethods() []string {
+	var methods []string
+	server.serviceMap.Range(func(_, v interface{}) bool {
+		svc := v.(*service)
+		for name, m := range svc.method {
+			if m.idempotent {
+				methods = append(methods, svc.name+"."+name)
+			}
+		}
+		return true
+	})
+	sort.Strings(methods)
+	return methods
+}
@@ -0,0 +1,99 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	runtimedebug "runtime/debug"
+)
+
+// ServerInfo 拦截器能看到的请求信息
+type ServerInfo struct {
+	ServiceMethod string
+	Metadata      map[string]string // 请求携带的元数据，与 MetadataFromContext 相同
+}
+
+// Handler 调用链的下一环，最后一环会真正调用服务方法
+type Handler func(ctx context.Context, argv, reply interface{}) error
+
+// Interceptor 包裹服务方法的调用，argv 是解码后的参数，reply 是返回值的指针。
+// 调用 next 继续执行，不调用 next 直接返回 error 可以拦截请求。
+// 传给 next 的 argv 和 reply 就是服务方法收到的值，可以换成同类型的值，argv 也可以换成参数的指针；
+// 换掉 reply 后服务方法写的是新的 reply，回复给客户端的仍然是拦截器收到的 reply，需要拦截器自己复制过去
+type Interceptor func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error
+
+// Use 添加拦截器，先添加的在外层，按添加的顺序执行
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// ErrServicePanic 服务方法或拦截器发生 panic 时回复给客户端的错误，
+// 错误信息为 "rpc server: service panic: " 加上 panic 的值
+var ErrServicePanic = errors.New("rpc server: service panic")
+
+// ErrRetryable 服务方法返回 Retryable 包装的错误时，客户端可以重试幂等的方法，
+// 错误信息为 "rpc server: retryable: " 加上原来的错误信息
+var ErrRetryable = errors.New("rpc server: retryable")
+
+// Retryable 把服务方法的错误标记为可以重试的临时错误，例如依赖的服务暂时不可用
+func Retryable(err error) error {
+	return fmt.Errorf("%w: %v", ErrRetryable, err)
+}
+
+// invoke 经过拦截器链调用服务方法，发生 panic 时打印调用栈并返回 ErrServicePanic
+func (server *Server) invoke(ctx context.Context, reply *Reply) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc server: %s panic: %v\n%s", reply.h.ServiceMethod, r, runtimedebug.Stack())
+			err = fmt.Errorf("%w: %v", ErrServicePanic, r)
+		}
+	}()
+	server.mu.RLock()
+	interceptors := server.interceptors
+	server.mu.RUnlock()
+
+	if len(interceptors) == 0 {
+		return reply.svc.callContext(ctx, reply.mtype, reply.argv, reply.msg)
+	}
+	handler := func(ctx context.Context, argv, replyv interface{}) error {
+		av, err := handlerValue(argv, reply.argv)
+		if err != nil {
+			return err
+		}
+		rv, err := handlerValue(replyv, reply.msg)
+		if err != nil {
+			return err
+		}
+		return reply.svc.callContext(ctx, reply.mtype, av, rv)
+	}
+	info := &ServerInfo{
+		ServiceMethod: reply.h.ServiceMethod,
+		Metadata:      MetadataFromContext(ctx),
+	}
+	// 从内往外包裹，第一个拦截器在最外层
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, replyv interface{}) error {
+			return interceptor(ctx, info, argv, replyv, next)
+		}
+	}
+	return handler(ctx, reply.argv.Interface(), reply.msg.Interface())
+}
+
+// handlerValue 把拦截器传给 next 的值转换成服务方法的参数，expect 是解码时创建的值，
+// 类型相同时直接使用，是它的指针时取指向的值
+func handlerValue(v interface{}, expect reflect.Value) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid():
+	case rv.Type() == expect.Type():
+		return rv, nil
+	case rv.Kind() == reflect.Ptr && rv.Type().Elem() == expect.Type() && !rv.IsNil():
+		return rv.Elem(), nil
+	}
+	return reflect.Value{}, fmt.Errorf("rpc server: interceptor passed %T to the method, expect %s", v, expect.Type())
+}
@@ -0,0 +1,105 @@
+package rpcserver
+
+import (
+	endecode "aRPC/edcode"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newTestReply(server *Server, serviceMethod string, args Args, md map[string]string) (*Reply, context.Context) {
+	svc, mtype, err := server.findService(serviceMethod)
+	_assert(err == nil, "find service error: %v", err)
+	reply := &Reply{
+		h:     &endecode.Header{ServiceMethod: serviceMethod, Metadata: md},
+		svc:   svc,
+		mtype: mtype,
+		argv:  mtype.newArgv(),
+		msg:   mtype.newReply(),
+	}
+	reply.argv.Set(reflect.ValueOf(args))
+	return reply, newMetadataContext(context.Background(), md)
+}
+
+func TestServer_Use(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+
+	var order []string
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		order = append(order, "outer:"+info.ServiceMethod+":"+info.Metadata["user"])
+		err := next(ctx, argv, reply)
+		order = append(order, "outer done")
+		return err
+	}, func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		args := argv.(Args)
+		order = append(order, "inner")
+		if args.Num1 < 0 {
+			return errors.New("negative number")
+		}
+		err := next(ctx, argv, reply)
+		*reply.(*int) *= 10
+		return err
+	})
+
+	reply, ctx := newTestReply(server, "Foo.Sum", Args{Num1: 1, Num2: 2}, map[string]string{"user": "u1"})
+	err := server.invoke(ctx, reply)
+	_assert(err == nil && *reply.msg.Interface().(*int) == 30, "expect reply changed by interceptor, got %v", err)
+	_assert(reflect.DeepEqual(order, []string{"outer:Foo.Sum:u1", "inner", "outer done"}), "wrong order %v", order)
+
+	// short-circuit before the method is called
+	reply, ctx = newTestReply(server, "Foo.Sum", Args{Num1: -1, Num2: 2}, nil)
+	calls := reply.mtype.NumCalls()
+	err = server.invoke(ctx, reply)
+	_assert(err != nil && err.Error() == "negative number", "expect interceptor error, got %v", err)
+	_assert(reply.mtype.NumCalls() == calls, "method should not be called")
+}
+
+func TestServer_UseReplaceValues(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	// the method sees the argv passed to next, as a value or a pointer
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		args := argv.(Args)
+		args.Num1 *= 100
+		return next(ctx, args, reply)
+	}, func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		args := argv.(Args)
+		args.Num2 *= 10
+		// the method writes into the new reply, copy it back
+		var sum int
+		err := next(ctx, &args, &sum)
+		*reply.(*int) = sum + 1
+		return err
+	})
+	reply, ctx := newTestReply(server, "Foo.Sum", Args{Num1: 1, Num2: 2}, nil)
+	err := server.invoke(ctx, reply)
+	_assert(err == nil && *reply.msg.Interface().(*int) == 121, "expect replaced argv and reply used, got %d %v", *reply.msg.Interface().(*int), err)
+
+	server = NewServer()
+	_ = server.Register(&foo)
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		return next(ctx, "wrong", reply)
+	})
+	reply, ctx = newTestReply(server, "Foo.Sum", Args{Num1: 1, Num2: 2}, nil)
+	calls := reply.mtype.NumCalls()
+	err = server.invoke(ctx, reply)
+	_assert(err != nil && err.Error() == "rpc server: interceptor passed string to the method, expect rpcserver.Args", "expect type error, got %v", err)
+	_assert(reply.mtype.NumCalls() == calls, "method should not be called")
+}
+
+func TestServer_InvokePanic(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		panic("interceptor panic")
+	})
+	reply, ctx := newTestReply(server, "Foo.Sum", Args{Num1: 1, Num2: 2}, nil)
+	err := server.invoke(ctx, reply)
+	_assert(errors.Is(err, ErrServicePanic) && err.Error() == "rpc server: service panic: interceptor panic",
+		"expect panic error, got %v", err)
+}
@@ -0,0 +1,70 @@
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// 请求元数据和响应元数据都挂在传给服务方法的 ctx 上
+type metadataKey struct{}
+type replyMetadataKey struct{}
+
+// replyMetadata 服务方法超时后可能还在写，回复时需要加锁复制一份
+type replyMetadata struct {
+	mu sync.Mutex
+	md map[string]string
+}
+
+func (r *replyMetadata) copy() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.md) == 0 {
+		return nil
+	}
+	md := make(map[string]string, len(r.md))
+	for k, v := range r.md {
+		md[k] = v
+	}
+	return md
+}
+
+func newMetadataContext(ctx context.Context, md map[string]string) context.Context {
+	ctx = context.WithValue(ctx, metadataKey{}, md)
+	return context.WithValue(ctx, replyMetadataKey{}, &replyMetadata{})
+}
+
+// MetadataFromContext 返回客户端随请求发送的元数据，返回的是副本，修改不会影响其他读者
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	ret := make(map[string]string, len(md))
+	for k, v := range md {
+		ret[k] = v
+	}
+	return ret
+}
+
+var ErrNoReplyMetadata = errors.New("rpc server: context does not belong to a request")
+
+// SetReplyMetadata 设置随响应返回给客户端的元数据，需要在方法返回之前调用
+func SetReplyMetadata(ctx context.Context, key, value string) error {
+	r, ok := ctx.Value(replyMetadataKey{}).(*replyMetadata)
+	if !ok {
+		return ErrNoReplyMetadata
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		r.md = make(map[string]string)
+	}
+	r.md[key] = value
+	return nil
+}
+
+func replyMetadataFromContext(ctx context.Context) map[string]string {
+	r, ok := ctx.Value(replyMetadataKey{}).(*replyMetadata)
+	if !ok {
+		return nil
+	}
+	return r.copy()
+}
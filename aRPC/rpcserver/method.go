@@ -1,19 +1,34 @@
 package rpcserver
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
 	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
 )
 
 type methodType struct {
 	method    reflect.Method //方法本身，名字啥的都有
 	ArgType   reflect.Type
 	ReplyType reflect.Type
+	withCtx   bool //第一个参数是否为 context.Context
 	numCalls  uint64
+
+	idempotent bool         //服务通过 IdempotentMethods 声明的幂等方法，在握手时告诉客户端
+	stream     reflect.Type //服务端流式和双向流式方法的 ServerStream[R] 参数类型，ReplyType 为 R
+	recvStream reflect.Type //客户端流式和双向流式方法的 ClientStream[A] 参数类型，ArgType 为 A
+	protobuf   bool         //参数和返回值都是 proto.Message 或 []byte，可以用 ProtobufCodec 调用
 }
 
+var (
+	typeOfContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	typeOfBytes        = reflect.TypeOf([]byte(nil))
+)
+
 //实现三个方法，调用次数，创建两个新类型实例
 
 func (m *methodType) NumCalls() uint64 {
@@ -62,42 +77,97 @@ func newService(instance interface{}) *service {
 	}
 	//对方法进行注册
 	s.registerServer()
+	s.markIdempotent()
 	return s
 }
+
+// IdempotentMethods 服务实现这个接口声明哪些方法是幂等的（只写方法名），
+// 客户端在握手时得到这些方法，出错时可以安全地重试
+type IdempotentMethods interface {
+	IdempotentMethods() []string
+}
+
+func (s *service) markIdempotent() {
+	im, ok := s.instance.Interface().(IdempotentMethods)
+	if !ok {
+		return
+	}
+	for _, name := range im.IdempotentMethods() {
+		if m := s.method[name]; m != nil {
+			m.idempotent = true
+		} else {
+			log.Printf("rpc server: %s.%s is not a method, can't mark it idempotent\n", s.name, name)
+		}
+	}
+}
 func (s *service) registerServer() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		//支持两种签名：func(T, Args, *Reply) error 和 func(T, context.Context, Args, *Reply) error，
+		//*Reply 换成 ServerStream[R] 时是服务端流式方法，Args 换成 ClientStream[A] 时是客户端流式方法，
+		//两个都换时是双向流式方法
+		withCtx := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if (mType.NumIn() != 3 && !withCtx) || mType.NumOut() != 1 {
 			continue
 		}
 		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+		var streamType, recvStreamType reflect.Type
+		if isStream(replyType, typeOfServerStream) {
+			streamType, replyType = replyType, streamReplyType(replyType)
+		}
+		if isStream(argType, typeOfClientStream) {
+			recvStreamType, argType = argType, streamArgType(argType)
+		}
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		m := &methodType{
+			method:     method,
+			ArgType:    argType,
+			ReplyType:  replyType,
+			withCtx:    withCtx,
+			stream:     streamType,
+			recvStream: recvStreamType,
 		}
+		//同一个服务端的连接可以用不同的编解码器，用 ProtobufCodec 调用时才在 ParserReply 中拒绝
+		m.protobuf = m.protobufTypes()
+		s.method[method.Name] = m
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
+
+// protobufTypes 检查 ProtobufCodec 能否解码参数、编码返回值：
+// 参数解码到 argvPointer(newArgv()) 里，客户端流也一样，返回值编码 *Reply 或者 ServerStream 发送的 R
+func (m *methodType) protobufTypes() bool {
+	argType := m.ArgType
+	if argType.Kind() != reflect.Ptr {
+		argType = reflect.PointerTo(argType)
+	}
+	decodable := argType.Implements(typeOfProtoMessage) || argType == reflect.PointerTo(typeOfBytes)
+	encodable := m.ReplyType.Implements(typeOfProtoMessage) || m.ReplyType == typeOfBytes
+	return decodable && encodable
+}
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+	return s.callContext(context.Background(), m, argv, replyv)
+}
+
+// callContext 方法声明了 context.Context 参数时把 ctx 传进去
+func (s *service) callContext(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1) //调用次数+1
 	f := m.method.Func
-	args := []reflect.Value{
-		s.instance,
-		argv,
-		replyv,
+	args := []reflect.Value{s.instance}
+	if m.withCtx {
+		args = append(args, reflect.ValueOf(ctx))
 	}
+	args = append(args, argv, replyv)
 	//f.Call(args) 返回的是一个 []reflect.Value，它包含了方法调用的返回值。
 	returnValues := f.Call(args)
 	//reflect.Value 类型提供了 Interface() 方法，该方法返回 reflect.Value 对应的实际值的接口表示。
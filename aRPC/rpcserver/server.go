@@ -2,6 +2,8 @@ package rpcserver
 
 import (
 	endecode "aRPC/edcode"
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	runtimedebug "runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -23,14 +26,21 @@ const MagicData = 0x3bef5c
 // 后续的 header 和 body 的编码方式由 Option 中的 CodeType 指定
 type Option struct {
 	MagicInt       int
+	Version        int // 协议版本，见 ProtocolVersion；client.Dial 等把 0 换成 ProtocolVersion，只有 client.NewClient 会发送 0
 	CodeType       endecode.Type
-	ConnectTimeout time.Duration // 0 means no limit
+	ConnectTimeout time.Duration // 0 means no limit，但是客户端等待握手应答最多 10 秒
 	HandleTimeout  time.Duration
+
+	Compression       endecode.Compression // body 的压缩算法，空表示不压缩
+	CompressThreshold int                  // body 编码后超过这个字节数才压缩，0 表示使用默认值
+
+	StreamWindow int // 服务端在客户端流中最多缓存的参数个数，0 表示 DefaultStreamWindow，最大为 MaxStreamWindow
 }
 
 // DefaultOption 设置一个默认格式
 var DefaultOption = &Option{
 	MagicInt:       MagicData,
+	Version:        ProtocolVersion,
 	CodeType:       endecode.GobType,
 	ConnectTimeout: time.Second * 10, //设置10秒钟的连接超时
 }
@@ -38,6 +48,16 @@ var DefaultOption = &Option{
 // Server 服务器
 type Server struct {
 	serviceMap sync.Map
+
+	mu               sync.RWMutex // protect following
+	interceptors     []Interceptor
+	listeners        map[net.Listener]struct{}
+	conns            map[*serverConn]struct{}
+	shutdown         bool
+	maxBatchSize     int // 0 表示 DefaultMaxBatchSize，见 SetBatchLimit
+	batchConcurrency int // 0 表示 DefaultBatchConcurrency
+
+	connWg sync.WaitGroup // wait until all connections are closed
 }
 
 func (server *Server) Register(instance interface{}) error {
@@ -82,11 +102,18 @@ func ListenAndHandle(s *Server, listener net.Listener) {
 	s.Accept(listener)
 }
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		//对于每一个客户端给一个连接
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("connect error")
+			if !server.isShutdown() {
+				log.Println("connect error")
+			}
 			return
 		}
 		go server.Parser(conn)
@@ -95,64 +122,182 @@ func (server *Server) Accept(lis net.Listener) {
 
 func (server *Server) Parser(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
-	/*54-68行，只解析一次(option)：
-	| Option | Header1 | Body1 | Header2 | Body2 | ...*/
+	/*只解析一次(option)，并回复握手应答：
+	| Option | HandshakeAck | Header1 | Body1 | Header2 | Body2 | ...*/
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("json parser err")
 		return
 	}
-	if opt.MagicInt != MagicData {
-		log.Printf("rpc server: invalid magic number %x\n", opt.MagicInt)
+	//json 解码器可能已经把后面的 header 和 body 读进了自己的缓冲区，需要还给编解码器
+	conn = &bufferedConn{r: bufio.NewReader(io.MultiReader(dec.Buffered(), conn)), ReadWriteCloser: conn}
+	ack := negotiate(&opt)
+	if !ack.Accepted {
+		log.Println(ack.Message)
+		if opt.Version != 0 {
+			_ = writeHandshakeAck(conn, ack)
+		}
+		return
 	}
+	if opt.Version != 0 {
+		ack.Idempotent = server.idempotentMethods()
+		if err := writeHandshakeAck(conn, ack); err != nil {
+			log.Println("rpc server: handshake error:", err)
+			return
+		}
+	}
+	opt = ack.Option
 	//找到编解码注册表的函数
 	f := endecode.NewCodecFuncMap[opt.CodeType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %server", opt.CodeType)
-		return
-	}
 	//具体报文解析：header+body
 	//f(conn)->Codec创造一个消息解译码器
-	server.ServeCodec(f(conn))
+	c, err := endecode.WithCompression(f(conn), opt.CodeType, opt.Compression, opt.CompressThreshold)
+	if err != nil {
+		log.Println("rpc server: compression error:", err)
+		return
+	}
+	server.ServeCodec(c, &opt)
+}
+
+// bufferedConn 先读完 json 解码器缓冲区里剩下的数据，再从连接里读
+type bufferedConn struct {
+	r       *bufio.Reader
+	skipped bool
+	io.ReadWriteCloser
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	if !b.skipped {
+		b.skipped = true
+		// json.Encoder 会在 Option 后面追加一个换行符，不属于后面的报文
+		if c, err := b.r.Peek(1); err == nil && c[0] == '\n' {
+			_, _ = b.r.Discard(1)
+		}
+	}
+	return b.r.Read(p)
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
-func (server *Server) ServeCodec(c endecode.Codec) {
-	sending := new(sync.Mutex) // make sure to send a complete response
-	wg := new(sync.WaitGroup)  // wait until all request are handled
+// ServeCodec 按 opt 中协商好的 HandleTimeout 处理每一个请求，Shutdown 之后直接关闭连接
+func (server *Server) ServeCodec(c endecode.Codec, opt *Option) {
+	sc := &serverConn{c: c}
+	if !server.trackConn(sc, true) {
+		_ = c.Close()
+		return
+	}
+	defer server.trackConn(sc, false)
+	sending := &sc.sending
+	cancels := &sc.cancels
+	wg := new(sync.WaitGroup) // wait until all request are handled
 	for {
 		//解析消息，最后没消息可读时会自动关闭连接
 		reply, err := server.ParserReply(c)
-		if err != nil {
-			if reply == nil {
-				//只有关闭了连接就会出现读到文件尾的错误。
-				if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
-					log.Println("rpc server: read header error:", err)
-				}
-				log.Println("handle done")
+		if reply == nil {
+			//只有关闭了连接就会出现读到文件尾的错误。
+			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Println("rpc server: read header error:", err)
+			}
+			log.Println("handle done")
+			break
+		}
+		//客户端放弃了请求，取消对应的 ctx
+		if reply.h.Cancel {
+			if err != nil {
+				log.Println("rpc server: read cancel frame error:", err)
 				break
 			}
-			reply.h.Error = err.Error()
-			sending.Lock()
-			err := c.WriteHeaderAndBody(reply.h, invalidRequest)
+			if cancel, ok := cancels.Load(reply.h.Seq); ok {
+				cancel.(context.CancelFunc)()
+			}
+			continue
+		}
+		//流的数据帧、窗口更新和半关闭，流已经结束时丢弃
+		if reply.h.Stream {
+			if ss, ok := sc.streams.Load(reply.h.Seq); ok {
+				err = ss.(*serverStream).frame(reply.h)
+			} else {
+				err = c.ReadBody(nil)
+			}
 			if err != nil {
-				log.Println("rpc server: write response error:", err)
+				log.Println("rpc server: read stream frame error:", err)
+				break
+			}
+			continue
+		}
+		//发送 GOAWAY 之后的新请求不处理也不回复
+		if !sc.accept(reply.h.Seq) {
+			continue
+		}
+		if err != nil {
+			//单向请求出错也不回复
+			if reply.h.OneWay {
+				log.Println("rpc server: one-way request error:", err)
+			} else {
+				reply.h.Error = err.Error()
+				reply.h.Metadata = nil
+				sending.Lock()
+				err := c.WriteHeaderAndBody(reply.h, invalidRequest)
+				if err != nil {
+					log.Println("rpc server: write response error:", err)
+				}
+				sending.Unlock()
 			}
-			sending.Unlock()
+			sc.end()
 			continue
 		}
-		//处理消息
+		//处理消息，ctx 在客户端的剩余时间到了或者客户端放弃请求时取消
+		var cancel context.CancelFunc
+		if reply.h.Timeout > 0 {
+			reply.ctx, cancel = context.WithTimeout(context.Background(), reply.h.Timeout)
+		} else {
+			reply.ctx, cancel = context.WithCancel(context.Background())
+		}
+		reply.ctx = newMetadataContext(reply.ctx, reply.h.Metadata)
+		cancels.Store(reply.h.Seq, cancel)
+		if reply.batch == nil && reply.mtype.streaming() {
+			reply.stream = newServerStream(reply.ctx, cancel, c, sending, reply.h, reply.mtype, opt.streamWindow())
+			sc.streams.Store(reply.h.Seq, reply.stream)
+			if reply.mtype.stream != nil {
+				reply.msg = reply.stream.value(reply.mtype.stream)
+			}
+			if reply.mtype.recvStream != nil {
+				reply.argv = reply.stream.recvValue(reply.mtype.recvStream)
+			}
+		}
 		wg.Add(1)
 		go func() {
 			defer func() {
-				recover()
+				//服务方法的 panic 已经在 invoke 中处理，Handle 回复时的 panic 在它自己的 goroutine 中处理，
+				//这里防止批量、流式和单向请求处理中的意外拖垮整个服务
+				if r := recover(); r != nil {
+					log.Printf("rpc server: handle %s panic: %v\n%s", reply.h.ServiceMethod, r, runtimedebug.Stack())
+				}
+				cancels.Delete(reply.h.Seq)
+				sc.streams.Delete(reply.h.Seq)
+				cancel()
+				sc.end()
 				wg.Done()
 			}()
-			server.Handle(c, reply, sending, 1)
+			switch {
+			case reply.batch != nil:
+				server.handleBatch(c, reply, sending, opt)
+			case reply.stream != nil:
+				server.handleStream(c, reply, sending)
+			case reply.h.OneWay:
+				server.handleOneWay(reply, opt.HandleTimeout)
+			default:
+				server.Handle(c, reply, sending, opt.HandleTimeout)
+			}
 		}()
 	}
+	//连接断开，客户端不会再等待这些请求
+	cancels.Range(func(_, cancel interface{}) bool {
+		cancel.(context.CancelFunc)()
+		return true
+	})
 	wg.Wait()
 	_ = c.Close()
 }
@@ -162,6 +307,9 @@ type Reply struct {
 	argv, msg reflect.Value    // reflect.Value用于表示一个值的反射信息
 	mtype     *methodType
 	svc       *service
+	ctx       context.Context // 传给服务方法的 ctx
+	stream    *serverStream   // 流式方法的流，argv 和 msg 为对应的 ClientStream[A] 和 ServerStream[R]
+	batch     *BatchRequest   // 批量调用的请求，svc 和 mtype 为空
 }
 
 func (server *Server) ParserReply(c endecode.Codec) (*Reply, error) {
@@ -173,6 +321,25 @@ func (server *Server) ParserReply(c endecode.Codec) (*Reply, error) {
 		return nil, err
 	}
 	req := &Reply{h: h}
+	if h.Cancel {
+		return req, c.ReadBody(nil)
+	}
+	//流帧的 body 由对应的流读取
+	if h.Stream {
+		return req, nil
+	}
+	//批量调用中的每个方法在处理时再查找
+	if h.Batch {
+		req.batch = new(BatchRequest)
+		if err := c.ReadBody(req.batch); err != nil {
+			log.Println("rpc server: read batch err:", err)
+			if errors.Is(err, endecode.ErrBodyType) {
+				return req, err
+			}
+			return nil, err
+		}
+		return req, nil
+	}
 	var err error
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
@@ -181,56 +348,135 @@ func (server *Server) ParserReply(c endecode.Codec) (*Reply, error) {
 		_ = c.ReadBody(nil)
 		return req, err
 	}
-	//创建两个空参数
-	req.argv = req.mtype.newArgv()
-	req.msg = req.mtype.newReply()
-
-	// make sure that argvi is a pointer, ReadBody need a pointer as parameter
-	argvi := req.argv.Interface()
-	if req.argv.Type().Kind() != reflect.Ptr {
-		argvi = req.argv.Addr().Interface()
+	//请求的调用方式需要和方法的签名一致
+	if !req.mtype.accepts(h) {
+		_ = c.ReadBody(nil)
+		return req, fmt.Errorf("rpc server: %s is a %s method", h.ServiceMethod, req.mtype.streamKind())
+	}
+	if !req.mtype.protobuf && isProtobuf(c) {
+		_ = c.ReadBody(nil)
+		return req, fmt.Errorf("%w: %s can't be called with the protobuf codec, expect proto.Message or []byte, got %s and %s",
+			endecode.ErrBodyType, h.ServiceMethod, req.mtype.ArgType, req.mtype.ReplyType)
 	}
+	//创建两个空参数，流式方法的回复通过 ServerStream 发送
+	if req.mtype.stream == nil {
+		req.msg = req.mtype.newReply()
+	}
+	//客户端流的参数随后通过数据帧发送，请求本身没有参数
+	if req.mtype.recvStream != nil {
+		return req, c.ReadBody(nil)
+	}
+	req.argv = req.mtype.newArgv()
 	//读入参数信息
-	if err := c.ReadBody(argvi); err != nil {
+	if err := c.ReadBody(argvPointer(req.argv)); err != nil {
 		log.Println("rpc server: read argv err:", err)
+		//参数类型不被编解码器支持时报文已经读完，回复错误后还可以继续处理后面的请求
+		if errors.Is(err, endecode.ErrBodyType) {
+			return req, err
+		}
 		return nil, err
 	}
 	return req, nil
 }
+
+// isProtobuf 连接是否使用 ProtobufCodec，压缩时看被包装的编解码器
+func isProtobuf(c endecode.Codec) bool {
+	if cc, ok := c.(*endecode.CompressCodec); ok {
+		c = cc.Codec
+	}
+	_, ok := c.(*endecode.ProtobufCodec)
+	return ok
+}
+
+// make sure that argvi is a pointer, ReadBody need a pointer as parameter
+func argvPointer(argv reflect.Value) interface{} {
+	if argv.Type().Kind() != reflect.Ptr {
+		return argv.Addr().Interface()
+	}
+	return argv.Interface()
+}
+
 func (server *Server) sendRequest(c endecode.Codec, h *endecode.Header, body interface{}, sending *sync.Mutex) {
 	defer sending.Unlock()
 	sending.Lock()
-	if err := c.WriteHeaderAndBody(h, body); err != nil {
+	err := c.WriteHeaderAndBody(h, body)
+	if errors.Is(err, endecode.ErrBodyType) {
+		//返回值类型不被编解码器支持，改为回复错误，否则客户端会一直等待
+		h.Error = err.Error()
+		err = c.WriteHeaderAndBody(h, invalidRequest)
+	}
+	if err != nil {
 		log.Println("rpc server sendRequest error:", err)
 	}
 
 }
+
+// Handle 调用服务方法并回复，timeout 为 0 表示不限制处理时间。
+// 超时或者客户端放弃请求后立即回复错误，并取消传给方法的 ctx，
+// 方法之后再返回时结果会被丢弃，保证每个 Seq 只回复一次
 func (server *Server) Handle(c endecode.Codec, reply *Reply, sending *sync.Mutex, timeout time.Duration) {
+	ctx := reply.ctx
+	if ctx == nil {
+		ctx = newMetadataContext(context.Background(), reply.h.Metadata)
+	}
+	var once sync.Once
+	respond := func(h endecode.Header, body interface{}) {
+		once.Do(func() {
+			//不回显请求的元数据，只带上服务方法设置的响应元数据
+			h.Metadata = replyMetadataFromContext(ctx)
+			server.sendRequest(c, &h, body, sending)
+		})
+	}
+	handleCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		handleCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	called := make(chan struct{})
-	sent := make(chan struct{})
 	go func() {
-		err := reply.svc.call(reply.mtype, reply.argv, reply.msg)
-		called <- struct{}{}
+		defer close(called)
+		defer func() {
+			//服务方法的 panic 已经在 invoke 中处理，这里是编码回复时的 panic，
+			//报文可能只写了一半，关闭连接让客户端的调用失败，而不是一直等待
+			if r := recover(); r != nil {
+				log.Printf("rpc server: reply %s panic: %v\n%s", reply.h.ServiceMethod, r, runtimedebug.Stack())
+				_ = c.Close()
+			}
+		}()
+		err := server.invoke(handleCtx, reply)
 		if err != nil {
-			reply.h.Error = err.Error()
-			server.sendRequest(c, reply.h, invalidRequest, sending)
+			h := *reply.h
+			h.Error = err.Error()
+			respond(h, invalidRequest)
 			log.Println("rpc server call error:", err)
-			sent <- struct{}{}
 			return
 		}
-		server.sendRequest(c, reply.h, reply.msg.Interface(), sending)
-		sent <- struct{}{}
+		respond(*reply.h, reply.msg.Interface())
 	}()
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
-	}
 	select {
-	case <-time.After(timeout):
-		reply.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendRequest(c, reply.h, invalidRequest, sending)
+	case <-handleCtx.Done():
+		h := *reply.h
+		if ctx.Err() == nil {
+			h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
+		} else {
+			h.Error = "rpc server: request canceled: " + ctx.Err().Error()
+		}
+		respond(h, invalidRequest)
 	case <-called:
-		<-sent
+	}
+}
+
+// handleOneWay 调用单向请求的服务方法，不回复，错误只记录日志。
+// timeout 到了只取消传给方法的 ctx
+func (server *Server) handleOneWay(reply *Reply, timeout time.Duration) {
+	ctx := reply.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := server.invoke(ctx, reply); err != nil {
+		log.Println("rpc server one-way call error:", err)
 	}
 }
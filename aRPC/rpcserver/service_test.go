@@ -1,9 +1,13 @@
 package rpcserver
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type Foo int
@@ -15,6 +19,13 @@ func (f Foo) Sum(args Args, reply *int) error {
 	return nil
 }
 
+type Bar int
+
+func (b Bar) Deadline(ctx context.Context, args int, reply *bool) error {
+	_, *reply = ctx.Deadline()
+	return nil
+}
+
 // it's not a exported Method
 func (f Foo) sum(args Args, reply *int) error {
 	*reply = args.Num1 + args.Num2
@@ -34,6 +45,39 @@ func TestNewService(t *testing.T) {
 	_assert(mType != nil, "wrong Method, Sum shouldn't nil")
 }
 
+type Proto int
+
+func (p Proto) Double(args *wrapperspb.Int64Value, reply *wrapperspb.Int64Value) error {
+	reply.Value = args.Value * 2
+	return nil
+}
+
+func (p Proto) Raw(args []byte, reply *wrapperspb.BytesValue) error {
+	reply.Value = args
+	return nil
+}
+
+func (p Proto) Values(args *wrapperspb.Int64Value, stream ServerStream[*wrapperspb.Int64Value]) error {
+	return stream.Send(args)
+}
+
+func (p Proto) Last(stream ClientStream[*wrapperspb.Int64Value], reply *wrapperspb.Int64Value) error {
+	return nil
+}
+
+func TestNewService_Protobuf(t *testing.T) {
+	var foo Foo
+	s := newService(&foo)
+	_assert(!s.method["Sum"].protobuf, "Foo.Sum can't be called with the protobuf codec")
+
+	var p Proto
+	s = newService(&p)
+	_assert(len(s.method) == 4, "expect 4 methods, got %d", len(s.method))
+	for name, m := range s.method {
+		_assert(m.protobuf, "Proto.%s can be called with the protobuf codec", name)
+	}
+}
+
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
 	s := newService(&foo)
@@ -45,3 +89,41 @@ func TestMethodType_Call(t *testing.T) {
 	err := s.call(mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+func TestMethodType_CallContext(t *testing.T) {
+	var bar Bar
+	s := newService(&bar)
+	mType := s.method["Deadline"]
+	_assert(mType != nil && mType.withCtx, "wrong Method, Deadline should accept context")
+	_assert(mType.ArgType.Kind() == reflect.Int, "wrong ArgType %s", mType.ArgType)
+
+	argv := mType.newArgv()
+	replyv := mType.newReply()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.callContext(ctx, mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*bool), "failed to pass ctx to Bar.Deadline")
+}
+
+type Logs int
+
+func (l Logs) Tail(args int, stream ServerStream[string]) error {
+	return stream.Send("line")
+}
+
+func (l Logs) Follow(in ClientStream[int], out ServerStream[string]) error {
+	return nil
+}
+
+func TestNewService_Stream(t *testing.T) {
+	var logs Logs
+	s := newService(&logs)
+	mType := s.method["Tail"]
+	_assert(mType != nil && mType.stream != nil, "wrong Method, Tail should be a streaming method")
+	_assert(mType.ReplyType.Kind() == reflect.String, "wrong ReplyType %s", mType.ReplyType)
+	_assert(mType.stream.ConvertibleTo(typeOfServerStream), "wrong stream type %s", mType.stream)
+
+	mType = s.method["Follow"]
+	_assert(mType != nil && mType.streamKind() == "bidirectional streaming", "wrong Method, Follow should be a bidirectional streaming method")
+	_assert(mType.ArgType.Kind() == reflect.Int, "wrong ArgType %s", mType.ArgType)
+}
@@ -0,0 +1,161 @@
+package rpcserver
+
+import (
+	endecode "aRPC/edcode"
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// serverConn 一个正在处理的连接，Shutdown 通过它通知客户端并等待请求处理完
+type serverConn struct {
+	c       endecode.Codec
+	sending sync.Mutex // make sure to send a complete response
+	cancels sync.Map   // seq -> context.CancelFunc of the request in progress
+	streams sync.Map   // seq -> *serverStream of the streaming request in progress
+
+	mu       sync.Mutex // protect following
+	inflight int
+	lastSeq  uint64 // 最后一个接受的请求的 seq
+	draining bool   // 已经发送了 GOAWAY，请求处理完后关闭连接
+}
+
+// accept 接受一个新的请求，发送 GOAWAY 之后读到的请求不处理，
+// 客户端根据 GOAWAY 中的 seq 知道这些请求没有被接受
+func (sc *serverConn) accept(seq uint64) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.draining {
+		return false
+	}
+	sc.inflight++
+	if seq > sc.lastSeq {
+		sc.lastSeq = seq
+	}
+	return true
+}
+
+func (sc *serverConn) end() {
+	sc.mu.Lock()
+	sc.inflight--
+	idle := sc.draining && sc.inflight == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.close()
+	}
+}
+
+// goAway 通知客户端不要再发送新的请求，header 的 Seq 是最后一个接受的请求，
+// 客户端已经发出的更大的 seq 不会被处理。没有正在处理的请求时直接关闭连接，
+// 否则等最后一个请求回复后由 end 关闭
+func (sc *serverConn) goAway() {
+	//持有 sending 直到 GOAWAY 写完，end 不会在这之前关闭连接
+	sc.sending.Lock()
+	sc.mu.Lock()
+	sc.draining = true
+	h := &endecode.Header{Seq: sc.lastSeq, GoAway: true}
+	idle := sc.inflight == 0
+	sc.mu.Unlock()
+	err := sc.c.WriteHeaderAndBody(h, invalidRequest)
+	sc.sending.Unlock()
+	if err != nil {
+		log.Println("rpc server: send goaway error:", err)
+	}
+	if idle {
+		sc.close()
+	}
+}
+
+func (sc *serverConn) close() {
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	_ = sc.c.Close()
+}
+
+// forceClose 取消所有正在处理的请求并关闭连接
+func (sc *serverConn) forceClose() {
+	sc.cancels.Range(func(_, cancel interface{}) bool {
+		cancel.(context.CancelFunc)()
+		return true
+	})
+	_ = sc.c.Close()
+}
+
+// 记录 Accept 正在使用的 listener，Shutdown 之后不再接受新的 listener
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.shutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// 记录 ServeCodec 正在处理的连接，Shutdown 之后不再接受新的连接
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, sc)
+		server.connWg.Done()
+		return true
+	}
+	if server.shutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	server.connWg.Add(1)
+	return true
+}
+
+func (server *Server) isShutdown() bool {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.shutdown
+}
+
+// Shutdown 优雅地关闭服务端：关闭所有 listener，给每个连接发送 GOAWAY，
+// 等待正在处理的请求回复后关闭连接。ctx 结束时取消还没处理完的请求，
+// 强制关闭所有连接并返回 ctx.Err()
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.shutdown = true
+	for lis := range server.listeners {
+		_ = lis.Close()
+	}
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	for _, sc := range conns {
+		sc.goAway()
+	}
+	done := make(chan struct{})
+	go func() {
+		server.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, sc := range conns {
+			sc.forceClose()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,368 @@
+package rpcserver
+
+import (
+	endecode "aRPC/edcode"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ServerStream 服务端流式方法用它向客户端发送多个回复，方法签名为
+// func(T, Args, ServerStream[R]) error 或 func(T, context.Context, Args, ServerStream[R]) error。
+// 方法返回后流结束，返回的错误会发给客户端
+type ServerStream[R any] struct {
+	s *serverStream
+}
+
+// Send 发送一个回复，客户端的接收窗口用完时阻塞，
+// 客户端取消、超时或者断开连接时返回 ctx 的错误
+func (s ServerStream[R]) Send(reply R) error {
+	return s.s.send(reply)
+}
+
+// Context 带有请求的元数据，客户端取消、超时或者断开连接时结束
+func (s ServerStream[R]) Context() context.Context {
+	return s.s.ctx
+}
+
+// ClientStream 客户端流式方法用它接收客户端发送的多个参数，方法签名为
+// func(T, ClientStream[A], *Reply) error；和 ServerStream 一起使用时是双向流式方法：
+// func(T, ClientStream[A], ServerStream[R]) error。两种签名都可以在前面加上 context.Context
+type ClientStream[A any] struct {
+	s *serverStream
+}
+
+// Recv 返回下一个参数，客户端半关闭后返回 io.EOF，
+// 客户端取消、超时或者断开连接时返回 ctx 的错误。Recv 不能并发调用
+func (s ClientStream[A]) Recv() (A, error) {
+	args, err := s.s.recv()
+	if err != nil {
+		var zero A
+		return zero, err
+	}
+	//A 是指针时参数解码到它指向的值，见 newServerStream
+	if a, ok := args.(*A); ok {
+		return *a, nil
+	}
+	return args.(A), nil
+}
+
+// Context 带有请求的元数据，客户端取消、超时或者断开连接时结束
+func (s ClientStream[A]) Context() context.Context {
+	return s.s.ctx
+}
+
+// 服务端在客户端流中最多缓存的参数个数，由客户端在 Option.StreamWindow 中指定
+const (
+	DefaultStreamWindow = 32
+	MaxStreamWindow     = 1024
+)
+
+// streamWindow 返回服务端在客户端流中的接收窗口，negotiate 已经把 StreamWindow 限制在 MaxStreamWindow 以内
+func (opt *Option) streamWindow() uint32 {
+	if opt.StreamWindow <= 0 {
+		return DefaultStreamWindow
+	}
+	return uint32(opt.StreamWindow)
+}
+
+var (
+	// ErrStreamClosed 方法返回之后不能再调用 Send
+	ErrStreamClosed         = errors.New("rpc server: stream is closed")
+	errStreamWindowExceeded = errors.New("rpc server: stream window exceeded")
+)
+
+// 同一个泛型类型的所有实例的底层类型都相同，注册时据此识别流式方法，调用时转换成方法需要的类型
+var (
+	typeOfServerStream = reflect.TypeOf(ServerStream[any]{})
+	typeOfClientStream = reflect.TypeOf(ClientStream[any]{})
+)
+
+func isStream(t, stream reflect.Type) bool {
+	name := stream.Name()
+	return t.PkgPath() == stream.PkgPath() &&
+		strings.HasPrefix(t.Name(), name[:strings.IndexByte(name, '[')+1]) && t.ConvertibleTo(stream)
+}
+
+// streamReplyType 返回 ServerStream[R] 中的 R
+func streamReplyType(t reflect.Type) reflect.Type {
+	send, _ := t.MethodByName("Send")
+	return send.Type.In(1)
+}
+
+// streamArgType 返回 ClientStream[A] 中的 A
+func streamArgType(t reflect.Type) reflect.Type {
+	recv, _ := t.MethodByName("Recv")
+	return recv.Type.Out(0)
+}
+
+func (m *methodType) streaming() bool {
+	return m.stream != nil || m.recvStream != nil
+}
+
+func (m *methodType) streamKind() string {
+	switch {
+	case m.stream != nil && m.recvStream != nil:
+		return "bidirectional streaming"
+	case m.recvStream != nil:
+		return "client-streaming"
+	case m.stream != nil:
+		return "server-streaming"
+	}
+	return "unary"
+}
+
+// accepts 普通调用的请求没有窗口；服务端流式调用的请求带着参数，随后半关闭；
+// 客户端流式和双向流式调用的请求只打开流，参数随后通过数据帧发送
+func (m *methodType) accepts(h *endecode.Header) bool {
+	switch {
+	case h.Window == 0:
+		return !m.streaming()
+	case h.EndStream:
+		return m.stream != nil && m.recvStream == nil
+	default:
+		return m.recvStream != nil
+	}
+}
+
+/*
+流的报文，每个方向的数据帧都要消耗对方给的窗口：
+请求      | Header{Seq, Window: 初始窗口, EndStream} | Args |  客户端流和双向流的请求没有参数，EndStream 为 false
+数据帧    | Header{Seq, Stream: true} | Args 或 R |
+窗口更新  | Header{Seq, Stream: true, Window: n} | |           接收方读完 n 个帧后发送，服务端打开客户端流时先发送初始窗口
+半关闭    | Header{Seq, Stream: true, EndStream: true} | |     客户端不再发送参数
+结束帧    | Header{Seq, Error} | Reply |                       服务端方法返回后发送，只有客户端流式方法带着 Reply
+*/
+type serverStream struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	c       endecode.Codec
+	sending *sync.Mutex
+	h       endecode.Header // 数据帧的 header
+
+	mu      sync.Mutex // protect following
+	credits uint32
+	wake    chan struct{} // 收到窗口更新时关闭
+	closed  bool
+	err     error // 客户端违反了协议，取消 ctx 后由 Send 和 Recv 返回
+
+	// 客户端发送的参数，只有客户端流式方法和双向流式方法使用
+	newArg   func() interface{}
+	window   uint32
+	frames   chan interface{} // 容量为窗口大小，客户端不会发送更多的帧
+	consumed uint32           // 还没有还给客户端的窗口
+	recvEnd  chan struct{}    // 客户端半关闭时关闭
+	endOnce  sync.Once
+}
+
+func newServerStream(ctx context.Context, cancel context.CancelFunc, c endecode.Codec, sending *sync.Mutex, h *endecode.Header, m *methodType, window uint32) *serverStream {
+	s := &serverStream{
+		ctx:     ctx,
+		cancel:  cancel,
+		c:       c,
+		sending: sending,
+		h:       endecode.Header{ServiceMethod: h.ServiceMethod, Seq: h.Seq, Stream: true},
+		credits: h.Window,
+		wake:    make(chan struct{}),
+	}
+	if m.recvStream != nil {
+		//和普通请求的参数一样，A 是指针时解码到它指向的值，protobuf 的消息不能解码到 **pb.Msg
+		s.newArg = func() interface{} { return argvPointer(m.newArgv()) }
+		s.window = window
+		s.frames = make(chan interface{}, window)
+		s.recvEnd = make(chan struct{})
+	}
+	return s
+}
+
+// value 转换成 t 类型的 ServerStream[R]，作为方法的参数
+func (s *serverStream) value(t reflect.Type) reflect.Value {
+	return reflect.ValueOf(ServerStream[any]{s: s}).Convert(t)
+}
+
+// recvValue 转换成 t 类型的 ClientStream[A]，作为方法的参数
+func (s *serverStream) recvValue(t reflect.Type) reflect.Value {
+	return reflect.ValueOf(ClientStream[any]{s: s}).Convert(t)
+}
+
+// error 返回 ctx 结束的原因
+func (s *serverStream) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.ctx.Err()
+}
+
+func (s *serverStream) send(body interface{}) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	h := s.h
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	return s.c.WriteHeaderAndBody(&h, body)
+}
+
+// acquire 等待并消耗一个窗口，等待时不持有 sending，不影响同一个连接上的其他调用
+func (s *serverStream) acquire() error {
+	for {
+		if s.ctx.Err() != nil {
+			return s.error()
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return ErrStreamClosed
+		}
+		if s.credits > 0 {
+			s.credits--
+			s.mu.Unlock()
+			return nil
+		}
+		wake := s.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+// grant 客户端读完了 n 个帧，允许再发送 n 个
+func (s *serverStream) grant(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credits += n
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *serverStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// sendWindow 允许客户端再发送 n 个参数
+func (s *serverStream) sendWindow(n uint32) {
+	h := s.h
+	h.Window = n
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	if err := s.c.WriteHeaderAndBody(&h, invalidRequest); err != nil {
+		log.Println("rpc server: send stream window error:", err)
+	}
+}
+
+func (s *serverStream) recv() (interface{}, error) {
+	select {
+	case args := <-s.frames:
+		return s.take(args), nil
+	default:
+	}
+	select {
+	case args := <-s.frames:
+		return s.take(args), nil
+	case <-s.recvEnd:
+		//半关闭之前的数据帧已经在 frames 里了
+		select {
+		case args := <-s.frames:
+			return s.take(args), nil
+		default:
+			return nil, io.EOF
+		}
+	case <-s.ctx.Done():
+		return nil, s.error()
+	}
+}
+
+// take 每读完半个窗口的参数，把这些窗口还给客户端
+func (s *serverStream) take(args interface{}) interface{} {
+	s.consumed++
+	if s.consumed >= (s.window+1)/2 {
+		select {
+		case <-s.recvEnd:
+		case <-s.ctx.Done():
+		default:
+			s.sendWindow(s.consumed)
+		}
+		s.consumed = 0
+	}
+	return args
+}
+
+// frame 处理客户端发来的流帧，在读取请求的 goroutine 中调用，不会阻塞；
+// 返回的错误说明连接已经不能再读
+func (s *serverStream) frame(h *endecode.Header) error {
+	switch {
+	case h.Window > 0:
+		s.grant(h.Window)
+		return s.c.ReadBody(nil)
+	case h.EndStream:
+		if s.recvEnd != nil {
+			s.endOnce.Do(func() { close(s.recvEnd) })
+		}
+		return s.c.ReadBody(nil)
+	case s.newArg == nil:
+		_ = s.c.ReadBody(nil)
+		s.fail(fmt.Errorf("rpc server: %s doesn't accept a client stream", s.h.ServiceMethod))
+		return nil
+	}
+	args := s.newArg()
+	if err := s.c.ReadBody(args); err != nil {
+		if !errors.Is(err, endecode.ErrBodyType) {
+			return err
+		}
+		// the body has been consumed, keep the connection
+		s.fail(err)
+		return nil
+	}
+	select {
+	case s.frames <- args:
+	default:
+		s.fail(errStreamWindowExceeded)
+	}
+	return nil
+}
+
+// fail 客户端违反了协议，取消方法的 ctx，之后 Send 和 Recv 返回 err
+func (s *serverStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	log.Println("rpc server: stream error:", err)
+	s.cancel()
+}
+
+// handleStream 调用流式方法，方法返回后发送结束帧。
+// 流的持续时间不受 HandleTimeout 限制，只受客户端的 Timeout 和取消影响
+func (server *Server) handleStream(c endecode.Codec, reply *Reply, sending *sync.Mutex) {
+	//在处理请求的 goroutine 中发送初始窗口，不阻塞读取请求的循环
+	if reply.mtype.recvStream != nil {
+		reply.stream.sendWindow(reply.stream.window)
+	}
+	err := server.invoke(reply.ctx, reply)
+	reply.stream.close()
+	h := *reply.h
+	h.Window = 0
+	var body interface{} = invalidRequest
+	switch {
+	case err != nil:
+		h.Error = err.Error()
+		log.Println("rpc server stream error:", err)
+	case reply.mtype.stream == nil:
+		//客户端流式方法只有一个回复
+		body = reply.msg.Interface()
+	}
+	h.Metadata = replyMetadataFromContext(reply.ctx)
+	server.sendRequest(c, &h, body, sending)
+}
@@ -2,6 +2,7 @@ package timeout
 
 import (
 	client2 "aRPC/client"
+	"aRPC/edcode"
 	"aRPC/rpcserver"
 	"context"
 	"fmt"
@@ -19,6 +20,19 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+// canceled 收到 Bar.Wait 的 ctx 被取消的原因
+var canceled = make(chan error, 1)
+
+func (b Bar) Wait(ctx context.Context, argv int, reply *int) error {
+	select {
+	case <-ctx.Done():
+		canceled <- ctx.Err()
+	case <-time.After(time.Second * 5):
+		canceled <- nil
+	}
+	return nil
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = rpcserver.Register(&b)
@@ -39,19 +53,66 @@ func TestClient_Call(t *testing.T) {
 	go startServer(addrCh)
 	addr := <-addrCh
 	time.Sleep(time.Second)
+	for _, codec := range []edcode.Type{edcode.GobType, edcode.JsonType, edcode.MsgpackType} {
+		t.Run(string(codec), func(t *testing.T) {
+			testClientCall(t, addr, codec)
+		})
+	}
+}
+
+func testClientCall(t *testing.T, addr string, codec edcode.Type) {
 	t.Run("client timeout", func(t *testing.T) {
-		client, _ := client2.Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*1)
+		client, _ := client2.Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
 	})
 	t.Run("server handle timeout", func(t *testing.T) {
 		client, _ := client2.Dial("tcp", addr, &rpcserver.Option{
+			CodeType:      codec,
 			HandleTimeout: time.Second,
 		})
 		var reply int
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
 	})
+	t.Run("client cancel propagates", func(t *testing.T) {
+		client, _ := client2.Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*200, cancel)
+		var reply int
+		err := client.Call(ctx, "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "canceled"), "expect a canceled error")
+		_assert(<-canceled == context.Canceled, "expect server ctx canceled")
+	})
+	t.Run("client deadline propagates", func(t *testing.T) {
+		client, _ := client2.Dial("tcp", addr, &rpcserver.Option{CodeType: codec})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+		var reply int
+		_ = client.Call(ctx, "Bar.Wait", 1, &reply)
+		err := <-canceled
+		_assert(err == context.DeadlineExceeded || err == context.Canceled, "expect server ctx done, got %v", err)
+	})
+	t.Run("handle timeout cancels ctx", func(t *testing.T) {
+		client, _ := client2.Dial("tcp", addr, &rpcserver.Option{
+			CodeType:      codec,
+			HandleTimeout: time.Millisecond * 200,
+		})
+		var reply int
+		err := client.Call(context.Background(), "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(<-canceled == context.DeadlineExceeded, "expect server ctx deadline exceeded")
+	})
+	t.Run("server handle in time", func(t *testing.T) {
+		client, _ := client2.Dial("tcp", addr, &rpcserver.Option{
+			CodeType:      codec,
+			HandleTimeout: time.Second * 3,
+		})
+		var reply int
+		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+		_assert(err == nil, "expect no error, got %v", err)
+	})
 }
@@ -0,0 +1,93 @@
+package xclient
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type SelectMode int
+
+const (
+	RandomSelect             SelectMode = iota // select randomly
+	RoundRobinSelect                           // select using Robbin algorithm
+	WeightedRoundRobinSelect                   // select using smooth weighted Robbin algorithm, see XClient.SetWeight
+	LeastPendingSelect                         // select the server with the least pending calls
+)
+
+// Discovery 服务发现的接口，服务地址格式为 protocol@addr，与 client.XDial 一致
+type Discovery interface {
+	Refresh() error // refresh from remote registry
+	Update(servers []string) error
+	Get(mode SelectMode) (string, error)
+	GetAll() ([]string, error)
+}
+
+var ErrNoServers = errors.New("rpc discovery: no available servers")
+
+// MultiServersDiscovery is a discovery for multi servers without a registry center
+// user provides the server addresses explicitly instead
+type MultiServersDiscovery struct {
+	r       *rand.Rand   // generate random number
+	mu      sync.RWMutex // protect following
+	servers []string
+	index   int // record the selected position for robin algorithm
+}
+
+var _ Discovery = (*MultiServersDiscovery)(nil)
+
+// NewMultiServerDiscovery creates a MultiServersDiscovery instance
+func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
+	d := &MultiServersDiscovery{
+		servers: servers,
+		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	//初始位置随机，避免每个客户端都从第一个服务开始轮询
+	d.index = d.r.Intn(math.MaxInt32 - 1)
+	return d
+}
+
+// Refresh doesn't make sense for MultiServersDiscovery, so ignore it
+func (d *MultiServersDiscovery) Refresh() error {
+	return nil
+}
+
+// Update the servers of discovery dynamically if needed
+func (d *MultiServersDiscovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = servers
+	return nil
+}
+
+// Get a server according to mode
+func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.servers)
+	if n == 0 {
+		return "", ErrNoServers
+	}
+	switch mode {
+	case RandomSelect:
+		return d.servers[d.r.Intn(n)], nil
+	case RoundRobinSelect:
+		s := d.servers[d.index%n] // servers could be updated, so mode n to ensure safety
+		d.index = (d.index + 1) % n
+		return s, nil
+	default:
+		return "", errors.New("rpc discovery: not supported select mode")
+	}
+}
+
+// GetAll returns all servers in discovery
+func (d *MultiServersDiscovery) GetAll() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	// return a copy of d.servers
+	servers := make([]string, len(d.servers))
+	copy(servers, d.servers)
+	return servers, nil
+}
@@ -0,0 +1,150 @@
+package xclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileDiscovery 从本地文件读取服务列表，并定时检查文件的修改时间，变化后重新加载。
+// 支持两种文件格式：
+// JSON: ["tcp@127.0.0.1:9999", "http@127.0.0.1:8888"] 或 {"servers": [...]}
+// YAML: 每行一个 "- tcp@127.0.0.1:9999"，可以放在 servers: 下面
+type FileDiscovery struct {
+	*MultiServersDiscovery
+	path     string
+	interval time.Duration //检查文件变化的间隔
+	modTime  time.Time     //上一次加载时文件的修改时间
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+const defaultWatchInterval = time.Second * 5
+
+var _ Discovery = (*FileDiscovery)(nil)
+
+// NewFileDiscovery 先加载一次文件，出错直接返回，然后在后台每隔 interval 检查一次文件
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+	if interval == 0 {
+		interval = defaultWatchInterval
+	}
+	d := &FileDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		path:                  path,
+		interval:              interval,
+		done:                  make(chan struct{}),
+	}
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	go d.watch()
+	return d, nil
+}
+
+func (d *FileDiscovery) watch() {
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-t.C:
+			if err := d.Refresh(); err != nil {
+				//文件暂时读不到或者格式错误时保留旧的服务列表
+				log.Println("rpc discovery: reload file err:", err)
+			}
+		}
+	}
+}
+
+// Refresh 文件的修改时间没有变化时直接返回，否则重新解析文件
+func (d *FileDiscovery) Refresh() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	d.mu.RLock()
+	unchanged := info.ModTime().Equal(d.modTime)
+	d.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	servers, err := parseServers(d.path, data)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = servers
+	d.modTime = info.ModTime()
+	log.Printf("rpc discovery: load %d servers from %s\n", len(servers), d.path)
+	return nil
+}
+
+// Close 停止后台检查文件
+func (d *FileDiscovery) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+func parseServers(path string, data []byte) ([]string, error) {
+	var servers []string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		servers = parseYamlServers(data)
+	default:
+		var err error
+		if servers, err = parseJsonServers(data); err != nil {
+			return nil, fmt.Errorf("rpc discovery: parse %s err: %v", path, err)
+		}
+	}
+	for _, s := range servers {
+		if !strings.Contains(s, "@") {
+			return nil, fmt.Errorf("rpc discovery: wrong format '%s', expect protocol@addr", s)
+		}
+	}
+	return servers, nil
+}
+
+func parseJsonServers(data []byte) ([]string, error) {
+	var servers []string
+	if err := json.Unmarshal(data, &servers); err == nil {
+		return servers, nil
+	}
+	var wrapped struct {
+		Servers []string `json:"servers"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Servers, nil
+}
+
+// 只解析字符串列表，不需要完整的 YAML 实现
+func parseYamlServers(data []byte) []string {
+	servers := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "-") {
+			continue
+		}
+		s := strings.Trim(strings.TrimSpace(line[1:]), `"'`)
+		if s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
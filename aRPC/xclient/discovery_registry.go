@@ -0,0 +1,157 @@
+package xclient
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RegistryDiscovery 从注册中心拉取服务列表，本地缓存 timeout 时间，过期后再重新拉取。
+// 拉取失败时保留之前的服务列表，retryInterval 之内不再访问注册中心
+type RegistryDiscovery struct {
+	*MultiServersDiscovery
+	registry      string        //注册中心地址，如 http://localhost:9999/_geerpc_/registry
+	timeout       time.Duration //服务列表的过期时间
+	lastUpdate    time.Time     //最后从注册中心更新服务列表的时间，由 mu 保护
+	httpClient    *http.Client
+	retryInterval time.Duration
+
+	refreshing  sync.Mutex //同一时间只有一个 Refresh 访问注册中心，保护 lastFailure 和 lastErr
+	lastFailure time.Time
+	lastErr     error
+	background  atomic.Bool //Get 和 GetAll 已经在后台刷新
+}
+
+const (
+	defaultUpdateTimeout = time.Second * 10
+	defaultFetchTimeout  = time.Second * 5 //访问注册中心的超时时间
+	defaultRetryInterval = time.Second     //拉取失败后等待多久再访问注册中心
+)
+
+var _ Discovery = (*RegistryDiscovery)(nil)
+
+func NewRegistryDiscovery(registerAddr string, timeout time.Duration) *RegistryDiscovery {
+	if timeout == 0 {
+		timeout = defaultUpdateTimeout
+	}
+	d := &RegistryDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		registry:              registerAddr,
+		timeout:               timeout,
+		httpClient:            &http.Client{Timeout: defaultFetchTimeout},
+		retryInterval:         defaultRetryInterval,
+	}
+	return d
+}
+
+func (d *RegistryDiscovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = servers
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+func (d *RegistryDiscovery) fresh() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.lastUpdate.Add(d.timeout).After(time.Now())
+}
+
+// Refresh 缓存未过期时直接返回，否则向注册中心发送 GET 请求拉取最新的服务列表。
+// 请求时不持有 mu，Get 和 GetAll 可以继续使用之前的服务列表；
+// 上次拉取失败不到 retryInterval 时直接返回上次的错误，注册中心不可用时调用方不会排队等待
+func (d *RegistryDiscovery) Refresh() error {
+	if d.fresh() {
+		return nil
+	}
+	d.refreshing.Lock()
+	defer d.refreshing.Unlock()
+	//等待的时候其他 Refresh 可能已经更新了，或者刚刚失败
+	if d.fresh() {
+		return nil
+	}
+	if d.lastErr != nil && time.Since(d.lastFailure) < d.retryInterval {
+		return d.lastErr
+	}
+	log.Println("rpc registry: refresh servers from registry", d.registry)
+	servers, err := d.fetch()
+	if err != nil {
+		log.Println("rpc registry refresh err:", err)
+		d.lastErr, d.lastFailure = err, time.Now()
+		return err
+	}
+	d.lastErr = nil
+	return d.Update(servers)
+}
+
+// refreshCached 缓存过期但是服务列表不为空时在后台刷新，同一时间只有一个，调用方直接使用之前的服务列表；
+// 服务列表为空时返回 false，由调用方等待 Refresh
+func (d *RegistryDiscovery) refreshCached() bool {
+	if d.fresh() {
+		return true
+	}
+	d.mu.RLock()
+	cached := len(d.servers) > 0
+	d.mu.RUnlock()
+	if !cached {
+		return false
+	}
+	if d.background.CompareAndSwap(false, true) {
+		go func() {
+			defer d.background.Store(false)
+			_ = d.Refresh()
+		}()
+	}
+	return true
+}
+
+func (d *RegistryDiscovery) fetch() ([]string, error) {
+	resp, err := d.httpClient.Get(d.registry)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("rpc registry: unexpected status %s", resp.Status)
+	}
+	servers := make([]string, 0)
+	for _, server := range strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",") {
+		if strings.TrimSpace(server) != "" {
+			servers = append(servers, strings.TrimSpace(server))
+		}
+	}
+	return servers, nil
+}
+
+// Get 之前的服务列表不为空时直接从中选择，过期时在后台刷新
+func (d *RegistryDiscovery) Get(mode SelectMode) (string, error) {
+	if d.refreshCached() {
+		return d.MultiServersDiscovery.Get(mode)
+	}
+	if err := d.Refresh(); err != nil {
+		if s, e := d.MultiServersDiscovery.Get(mode); e == nil {
+			return s, nil
+		}
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+// GetAll 之前的服务列表不为空时直接返回它，过期时在后台刷新
+func (d *RegistryDiscovery) GetAll() ([]string, error) {
+	if d.refreshCached() {
+		return d.MultiServersDiscovery.GetAll()
+	}
+	if err := d.Refresh(); err != nil {
+		if servers, _ := d.MultiServersDiscovery.GetAll(); len(servers) > 0 {
+			return servers, nil
+		}
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
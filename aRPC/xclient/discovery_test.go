@@ -0,0 +1,156 @@
+package xclient
+
+import (
+	"aRPC/registry"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestMultiServersDiscovery(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		s, err := d.Get(RoundRobinSelect)
+		_assert(err == nil, "get error: %v", err)
+		seen[s] = true
+	}
+	_assert(len(seen) == 3, "round robin should visit every server, got %v", seen)
+
+	_ = d.Update(nil)
+	_, err := d.Get(RandomSelect)
+	_assert(err == ErrNoServers, "expect ErrNoServers, got %v", err)
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "servers.json")
+	_ = os.WriteFile(path, []byte(`["tcp@127.0.0.1:1"]`), 0644)
+	d, err := NewFileDiscovery(path, time.Millisecond*20)
+	_assert(err == nil, "new file discovery error: %v", err)
+	defer func() { _ = d.Close() }()
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 1 && servers[0] == "tcp@127.0.0.1:1", "wrong servers %v", servers)
+
+	_ = os.WriteFile(path, []byte(`{"servers": ["tcp@127.0.0.1:1", "http@127.0.0.1:2"]}`), 0644)
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(path, later, later)
+	time.Sleep(time.Millisecond * 100)
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 2, "expect file reloaded, got %v", servers)
+
+	yaml := filepath.Join(dir, "servers.yaml")
+	_ = os.WriteFile(yaml, []byte("servers:\n  - tcp@127.0.0.1:1 # primary\n  - \"http@127.0.0.1:2\"\n"), 0644)
+	y, err := NewFileDiscovery(yaml, time.Second)
+	_assert(err == nil, "new yaml discovery error: %v", err)
+	defer func() { _ = y.Close() }()
+	servers, _ = y.GetAll()
+	_assert(len(servers) == 2 && servers[1] == "http@127.0.0.1:2", "wrong yaml servers %v", servers)
+
+	_ = os.WriteFile(path, []byte(`["127.0.0.1:1"]`), 0644)
+	_, err = NewFileDiscovery(path, time.Second)
+	_assert(err != nil, "expect format error")
+}
+
+func TestRegistryDiscovery(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_ = registry.Heartbeat(ctx, ts.URL, "tcp@127.0.0.1:1", time.Minute)
+
+	d := NewRegistryDiscovery(ts.URL, time.Millisecond*50)
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 1, "expect 1 server, got %v %v", servers, err)
+
+	_ = registry.Heartbeat(ctx, ts.URL, "http@127.0.0.1:2", time.Minute)
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 1, "expect cached servers, got %v", servers)
+	time.Sleep(time.Millisecond * 60)
+	// the expired list is served while it is refreshed in the background
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 1, "expect cached servers while refreshing, got %v", servers)
+	time.Sleep(time.Millisecond * 20)
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 2, "expect refreshed servers, got %v", servers)
+}
+
+func TestRegistryDiscovery_Failure(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status == http.StatusOK {
+			w.Header().Set("X-Geerpc-Servers", "tcp@127.0.0.1:1")
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	d := NewRegistryDiscovery(ts.URL, time.Millisecond*20)
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 1, "expect 1 server, got %v %v", servers, err)
+
+	// a failed refresh keeps the previous servers
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	time.Sleep(time.Millisecond * 30)
+	_assert(d.Refresh() != nil, "expect non-2xx status rejected")
+	servers, err = d.GetAll()
+	_assert(err == nil && len(servers) == 1, "expect previous servers kept, got %v %v", servers, err)
+	s, err := d.Get(RandomSelect)
+	_assert(err == nil && s == "tcp@127.0.0.1:1", "expect previous server, got %q %v", s, err)
+
+	// a hung registry doesn't block the cached servers
+	hang := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer hung.Close()
+	defer close(hang)
+	d = NewRegistryDiscovery(hung.URL, time.Minute)
+	d.httpClient.Timeout = time.Millisecond * 100
+	_ = d.Update([]string{"tcp@127.0.0.1:1"})
+	d.lastUpdate = time.Time{}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			servers, err := d.GetAll()
+			_assert(err == nil && len(servers) == 1, "expect previous servers, got %v %v", servers, err)
+			_assert(time.Since(start) < time.Millisecond*50, "expect cached servers right away, took %s", time.Since(start))
+		}()
+	}
+	wg.Wait()
+
+	// without cached servers the callers wait for one fetch, not one each
+	d = NewRegistryDiscovery(hung.URL, time.Minute)
+	d.httpClient.Timeout = time.Millisecond * 100
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.GetAll()
+			_assert(err != nil, "expect fetch error")
+		}()
+	}
+	wg.Wait()
+	_assert(time.Since(start) < time.Millisecond*200, "expect callers to share the failed fetch, took %s", time.Since(start))
+}
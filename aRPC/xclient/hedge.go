@@ -0,0 +1,192 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// HedgePolicy 对冲请求：幂等的方法在 Delay 内没有完成时，把同样的请求发给另一个实例，
+// 采用最先成功的结果并取消其余的调用。
+// 服务端声明的幂等方法在握手时才知道，和任何实例建立连接之前只对冲 Idempotent 中的方法
+type HedgePolicy struct {
+	Delay       time.Duration // 发送下一个副本前等待的时间
+	UseP95      bool          // 样本足够时用该方法最近调用耗时的 p95 代替 Delay
+	MinSamples  int           // 使用 p95 需要的最少样本数，0 表示 20
+	MaxAttempts int           // 包括第一次调用最多发出的请求数，0 表示 2，不超过实例数
+	Idempotent  []string      // 可以对冲的方法 "Service.Method"，服务端声明的幂等方法也会对冲
+}
+
+const (
+	defaultHedgeSamples = 20
+	latencyWindowSize   = 100
+)
+
+// latencyWindow 记录最近 latencyWindowSize 次成功调用的耗时
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+func (w *latencyWindow) p95() time.Duration {
+	sorted := append([]time.Duration(nil), w.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)*95/100]
+}
+
+// SetHedging 开启对冲请求，policy 为 nil 时关闭
+func (xc *XClient) SetHedging(policy *HedgePolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if policy == nil {
+		xc.hedge = nil
+		return
+	}
+	p := *policy
+	if p.MinSamples <= 0 {
+		p.MinSamples = defaultHedgeSamples
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 2
+	}
+	xc.hedge = &p
+	xc.hedgeable = make(map[string]bool)
+	for _, method := range p.Idempotent {
+		xc.hedgeable[method] = true
+	}
+	xc.latencies = make(map[string]*latencyWindow)
+}
+
+// hedgePolicy 返回 serviceMethod 可以使用的对冲策略，不能对冲时返回 nil
+func (xc *XClient) hedgePolicy(serviceMethod string) *HedgePolicy {
+	xc.mu.Lock()
+	policy, hedgeable := xc.hedge, xc.hedgeable[serviceMethod]
+	xc.mu.Unlock()
+	if policy == nil || (!hedgeable && !xc.IsIdempotent(serviceMethod)) {
+		return nil
+	}
+	return policy
+}
+
+// hedgeDelay 样本足够时返回 p95，否则返回 Delay
+func (xc *XClient) hedgeDelay(policy *HedgePolicy, serviceMethod string) time.Duration {
+	if !policy.UseP95 {
+		return policy.Delay
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	w := xc.latencies[serviceMethod]
+	if w == nil || len(w.samples) < policy.MinSamples {
+		return policy.Delay
+	}
+	return w.p95()
+}
+
+func (xc *XClient) recordLatency(serviceMethod string, d time.Duration) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.latencies == nil {
+		return
+	}
+	w := xc.latencies[serviceMethod]
+	if w == nil {
+		w = &latencyWindow{}
+		xc.latencies[serviceMethod] = w
+	}
+	w.add(d)
+}
+
+// hedgeServers 第一个实例按照 SelectMode 选择，其余的实例随机排列
+func (xc *XClient) hedgeServers(max int) ([]string, error) {
+	first, err := xc.selectServer()
+	if err != nil {
+		return nil, err
+	}
+	servers := []string{first}
+	all, err := xc.d.GetAll()
+	if err != nil {
+		return servers, nil
+	}
+	for _, i := range rand.Perm(len(all)) {
+		if len(servers) >= max {
+			break
+		}
+		if all[i] != first {
+			servers = append(servers, all[i])
+		}
+	}
+	return servers, nil
+}
+
+type hedgeResult struct {
+	reply interface{}
+	err   error
+}
+
+// hedgedCall 先调用一个实例，每过一个对冲延迟或者前面的调用失败时再调用下一个实例，
+// 返回最先成功的结果；所有调用都失败时返回最后一个错误
+func (xc *XClient) hedgedCall(ctx context.Context, policy *HedgePolicy, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.hedgeServers(policy.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancel the calls still in flight
+	results := make(chan hedgeResult, len(servers))
+	start := time.Now()
+	launched, failed := 0, 0
+	launch := func() {
+		rpcAddr := servers[launched]
+		launched++
+		var clonedReply interface{}
+		if reply != nil {
+			clonedReply = newReply(reply)
+		}
+		go func() {
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- hedgeResult{reply: clonedReply, err: err}
+		}()
+	}
+	launch()
+	timer := time.NewTimer(xc.hedgeDelay(policy, serviceMethod))
+	defer timer.Stop()
+	for {
+		select {
+		case ret := <-results:
+			if ret.err == nil {
+				xc.recordLatency(serviceMethod, time.Since(start))
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(ret.reply).Elem())
+				}
+				return nil
+			}
+			failed++
+			err = ret.err
+			if failed == len(servers) {
+				return err
+			}
+			if launched < len(servers) && failed == launched {
+				launch()
+			}
+		case <-timer.C:
+			if launched < len(servers) {
+				launch()
+				timer.Reset(xc.hedgeDelay(policy, serviceMethod))
+			}
+		case <-ctx.Done():
+			return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package xclient
+
+import (
+	"aRPC/client"
+	"aRPC/rpcserver"
+	"context"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// XClient 支持多个服务实例的客户端，通过 Discovery 获取服务地址，
+// 按照 SelectMode 选择一个实例，每个地址复用一个 *client.Client
+type XClient struct {
+	d       Discovery
+	mode    SelectMode
+	opt     *rpcserver.Option
+	mu      sync.Mutex // protect following
+	clients map[string]*client.Client
+	dialing map[string]*dialCall //正在建立的连接，同一个地址只拨号一次
+	weights map[string]int       //加权轮询的权重，没有设置的默认为 1
+	current map[string]int       //平滑加权轮询中每个实例当前的权重
+
+	interceptors []client.Interceptor //添加到每个连接上的拦截器
+	breakers     *client.Breakers     //为 nil 时不熔断
+
+	hedge     *HedgePolicy //为 nil 时不对冲，见 SetHedging
+	hedgeable map[string]bool
+	latencies map[string]*latencyWindow //每个方法最近成功调用的耗时
+}
+
+var _ io.Closer = (*XClient)(nil)
+
+func NewXClient(d Discovery, mode SelectMode, opt *rpcserver.Option) *XClient {
+	return &XClient{
+		d:       d,
+		mode:    mode,
+		opt:     opt,
+		clients: make(map[string]*client.Client),
+		dialing: make(map[string]*dialCall),
+		weights: make(map[string]int),
+		current: make(map[string]int),
+	}
+}
+
+func (xc *XClient) Close() error {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for key, c := range xc.clients {
+		// I have no idea how to deal with error, just ignore it.
+		_ = c.Close()
+		delete(xc.clients, key)
+	}
+	return nil
+}
+
+// SetWeight 设置 WeightedRoundRobinSelect 模式下某个实例的权重，weight <= 0 时恢复默认值
+func (xc *XClient) SetWeight(rpcAddr string, weight int) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if weight <= 0 {
+		delete(xc.weights, rpcAddr)
+		return
+	}
+	xc.weights[rpcAddr] = weight
+}
+
+// Use 添加客户端拦截器，已经建立和之后建立的每个连接都会使用这些拦截器，
+// 拦截器在选出的实例上执行，Broadcast 和 Gather 中每个实例各执行一次
+func (xc *XClient) Use(interceptors ...client.Interceptor) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.interceptors = append(xc.interceptors, interceptors...)
+	for _, c := range xc.clients {
+		c.Use(interceptors...)
+	}
+}
+
+// SetBreakers 按实例地址和方法熔断，熔断器打开的实例直接返回 *client.BreakerOpenError，
+// 不会建立连接也不会发送请求
+func (xc *XClient) SetBreakers(breakers *client.Breakers) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.breakers = breakers
+}
+
+// IsIdempotent 已经建立连接的任意一个实例声明了 serviceMethod 是幂等的时返回 true，
+// 用 client.NewRetryClient 包装 XClient 时，服务端声明的幂等方法也会重试
+func (xc *XClient) IsIdempotent(serviceMethod string) bool {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for _, c := range xc.clients {
+		if c.IsIdempotent(serviceMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialCall 一次正在进行的拨号，同一个地址的其他调用等待它的结果
+type dialCall struct {
+	done chan struct{}
+	c    *client.Client
+	err  error
+}
+
+// 检查 xc.clients 是否有缓存的 Client，如果有，检查是否是可用状态，
+// 如果是则返回缓存的 Client，如果不可用，则从缓存中删除，重新创建。
+// 收到 GOAWAY 的 Client 上还有调用在等待回复，由服务端关闭，这里只从缓存中删除。
+// 拨号时不持有 xc.mu，一个连不上的实例不会阻塞其他实例的调用
+func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
+	xc.mu.Lock()
+	c, ok := xc.clients[rpcAddr]
+	if ok && !c.IsAvailable() {
+		if !c.IsGoingAway() {
+			_ = c.Close()
+		}
+		delete(xc.clients, rpcAddr)
+		c = nil
+	}
+	if c != nil {
+		xc.mu.Unlock()
+		return c, nil
+	}
+	if dc, ok := xc.dialing[rpcAddr]; ok {
+		xc.mu.Unlock()
+		<-dc.done
+		return dc.c, dc.err
+	}
+	dc := &dialCall{done: make(chan struct{})}
+	xc.dialing[rpcAddr] = dc
+	xc.mu.Unlock()
+
+	dc.c, dc.err = client.XDial(rpcAddr, xc.opt)
+	xc.mu.Lock()
+	delete(xc.dialing, rpcAddr)
+	if dc.err == nil {
+		dc.c.Use(xc.interceptors...)
+		xc.clients[rpcAddr] = dc.c
+	}
+	xc.mu.Unlock()
+	close(dc.done)
+	return dc.c, dc.err
+}
+
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	xc.mu.Lock()
+	breakers := xc.breakers
+	xc.mu.Unlock()
+	if breakers != nil {
+		var done func(error)
+		if done, err = breakers.Allow(rpcAddr, serviceMethod); err != nil {
+			return err
+		}
+		defer func() { done(err) }()
+	}
+	c, err := xc.dial(rpcAddr)
+	if err != nil {
+		return err
+	}
+	return c.Call(ctx, serviceMethod, args, reply)
+}
+
+// Call invokes the named function, waits for it to complete,
+// and returns its error status.
+// xc will choose a proper server.
+// 开启了对冲并且方法是幂等的时，慢的调用会同时发给其他实例，见 SetHedging
+func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if policy := xc.hedgePolicy(serviceMethod); policy != nil {
+		return xc.hedgedCall(ctx, policy, serviceMethod, args, reply)
+	}
+	rpcAddr, err := xc.selectServer()
+	if err != nil {
+		return err
+	}
+	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+}
+
+// 随机和轮询交给 Discovery，加权轮询和最少待处理请求需要用到 XClient 自己的状态
+func (xc *XClient) selectServer() (string, error) {
+	switch xc.mode {
+	case WeightedRoundRobinSelect, LeastPendingSelect:
+	default:
+		return xc.d.Get(xc.mode)
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", ErrNoServers
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.mode == LeastPendingSelect {
+		return xc.leastPending(servers), nil
+	}
+	return xc.weightedRoundRobin(servers), nil
+}
+
+// 还没有建立连接的实例待处理请求数视为 0
+func (xc *XClient) leastPending(servers []string) string {
+	best, min := servers[0], -1
+	for _, s := range servers {
+		n := 0
+		if c, ok := xc.clients[s]; ok && c.IsAvailable() {
+			n = c.NumPending()
+		}
+		if min == -1 || n < min {
+			best, min = s, n
+		}
+	}
+	return best
+}
+
+// 平滑加权轮询：每次给所有实例加上自己的权重，选出当前权重最大的，再减去总权重
+func (xc *XClient) weightedRoundRobin(servers []string) string {
+	total, best := 0, ""
+	current := make(map[string]int, len(servers))
+	for _, s := range servers {
+		w := xc.weights[s]
+		if w <= 0 {
+			w = 1
+		}
+		total += w
+		current[s] = xc.current[s] + w
+		if best == "" || current[s] > current[best] {
+			best = s
+		}
+	}
+	current[best] -= total
+	// servers could be updated, drop the state of removed servers
+	xc.current = current
+	return best
+}
+
+// Broadcast invokes the named function for every server registered in discovery
+// 任意一个实例出错时返回第一个错误，并通过 ctx 取消其余还未完成的调用；
+// reply 由任意一个成功的实例填充，为 nil 时不需要返回值；没有实例时返回 ErrNoServers
+func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.allServers()
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protect e and replyDone
+	var e error
+	replyDone := reply == nil // if reply is nil, don't need to set value
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = newReply(reply)
+			}
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && e == nil {
+				e = err
+				cancel() // if any call failed, cancel unfinished calls
+			}
+			if err == nil && !replyDone {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+				replyDone = true
+			}
+		}(rpcAddr)
+	}
+	wg.Wait()
+	return e
+}
+
+// GatherResult 是 Gather 中单个实例的调用结果
+type GatherResult struct {
+	Server string
+	Reply  interface{} // 与传入的 reply 类型相同的新实例
+	Error  error
+}
+
+// Gather 与 Broadcast 一样并发调用所有实例，但不会因为某个实例出错而取消其余调用，
+// 按 Discovery 返回的顺序给出每个实例各自的 reply 和 error；
+// 只有获取服务列表失败或者没有实例时才返回 error
+func (xc *XClient) Gather(ctx context.Context, serviceMethod string, args, reply interface{}) ([]*GatherResult, error) {
+	servers, err := xc.allServers()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*GatherResult, len(servers))
+	var wg sync.WaitGroup
+	for i, rpcAddr := range servers {
+		results[i] = &GatherResult{Server: rpcAddr}
+		if reply != nil {
+			results[i].Reply = newReply(reply)
+		}
+		wg.Add(1)
+		go func(ret *GatherResult) {
+			defer wg.Done()
+			ret.Error = xc.call(ret.Server, ctx, serviceMethod, args, ret.Reply)
+		}(results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// allServers 和 Get 一样，没有实例时返回 ErrNoServers
+func (xc *XClient) allServers() ([]string, error) {
+	servers, err := xc.d.GetAll()
+	if err == nil && len(servers) == 0 {
+		err = ErrNoServers
+	}
+	return servers, err
+}
+
+// 根据 reply 的类型创建一个新的实例，reply 必须是指针
+func newReply(reply interface{}) interface{} {
+	return reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+}
@@ -0,0 +1,348 @@
+package xclient
+
+import (
+	"aRPC/client"
+	"aRPC/rpcserver"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// Which 返回服务实例自己的编号，用来判断请求落在了哪个实例上
+func (f Foo) Which(args int, reply *int) error {
+	*reply = int(f)
+	return nil
+}
+
+// Sleep 编号为 1 的实例会出错，其余实例睡眠 args 毫秒
+func (f Foo) Sleep(args int, reply *int) error {
+	if f == 1 {
+		return errors.New("foo 1 failed")
+	}
+	time.Sleep(time.Millisecond * time.Duration(args))
+	*reply = int(f)
+	return nil
+}
+
+func startServer(id int) (string, net.Listener) {
+	foo := Foo(id)
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), l
+}
+
+func TestXClient_dial(t *testing.T) {
+	addr, l := startServer(1)
+	defer func() { _ = l.Close() }()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	c, err := xc.dial(addr)
+	_assert(err == nil && c.IsAvailable(), "dial error: %v", err)
+	c1, _ := xc.dial(addr)
+	_assert(c1 == c, "expect cached client reused")
+
+	// a closed client should be replaced on next dial
+	_ = c.Close()
+	c2, err := xc.dial(addr)
+	_assert(err == nil && c2 != c && c2.IsAvailable(), "expect unavailable client replaced")
+}
+
+func TestXClient_dialGoAway(t *testing.T) {
+	foo := Foo(2)
+	server := rpcserver.NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	addr := "tcp@" + l.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- xc.Call(context.Background(), "Foo.Sleep", 200, &reply)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	go func() { _ = server.Shutdown(context.Background()) }()
+	time.Sleep(time.Millisecond * 50)
+
+	// the next dial drops the client that got GOAWAY without failing the call on it
+	_, _ = xc.dial(addr)
+	_assert(<-done == nil, "expect the call in flight to finish after GOAWAY")
+}
+
+func TestXClient_dialOutsideLock(t *testing.T) {
+	addr, l := startServer(2)
+	defer func() { _ = l.Close() }()
+	// accepts connections but never answers the handshake
+	hole, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = hole.Close() }()
+	var dials int32
+	go func() {
+		for {
+			conn, err := hole.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	slow := "tcp@" + hole.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr, slow}), LeastPendingSelect, &rpcserver.Option{ConnectTimeout: 300 * time.Millisecond})
+	defer func() { _ = xc.Close() }()
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := xc.dial(slow)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	var reply int
+	err := xc.call(addr, context.Background(), "Foo.Which", 0, &reply)
+	_assert(err == nil && reply == 2, "call error: %v", err)
+	_, err = xc.selectServer()
+	_assert(err == nil && time.Since(start) < 100*time.Millisecond, "expect the slow dial not to block other servers, took %s", time.Since(start))
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		_assert(errors.Is(err, client.ErrConnectTimeout), "expect connect timeout, got %v", err)
+	}
+	_assert(atomic.LoadInt32(&dials) == 1, "expect concurrent dials to the same address shared, got %d", dials)
+}
+
+func TestXClient_WeightedRoundRobin(t *testing.T) {
+	xc := NewXClient(NewMultiServerDiscovery(nil), WeightedRoundRobinSelect, nil)
+	xc.SetWeight("tcp@a", 3)
+	servers := []string{"tcp@a", "tcp@b"}
+	count := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		count[xc.weightedRoundRobin(servers)]++
+	}
+	_assert(count["tcp@a"] == 6 && count["tcp@b"] == 2, "expect 3:1 distribution, got %v", count)
+}
+
+func TestXClient_LeastPending(t *testing.T) {
+	addr2, l2 := startServer(2)
+	addr3, l3 := startServer(3)
+	defer func() { _ = l2.Close() }()
+	defer func() { _ = l3.Close() }()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr2, addr3}), LeastPendingSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// servers without a connection count as idle
+	s, err := xc.selectServer()
+	_assert(err == nil && s == addr2, "expect the first idle server, got %q %v", s, err)
+
+	c2, _ := xc.dial(addr2)
+	c3, _ := xc.dial(addr3)
+	var calls []*client.Call
+	for i := 0; i < 3; i++ {
+		calls = append(calls, c2.Go("Foo.Sleep", 200, new(int), nil))
+	}
+	s, _ = xc.selectServer()
+	_assert(s == addr3, "expect the server without pending calls, got %q", s)
+	var reply int
+	err = xc.Call(context.Background(), "Foo.Which", 0, &reply)
+	_assert(err == nil && reply == 3, "expect the call routed to foo 3, got %d %v", reply, err)
+
+	for i := 0; i < 4; i++ {
+		calls = append(calls, c3.Go("Foo.Sleep", 200, new(int), nil))
+	}
+	s, _ = xc.selectServer()
+	_assert(s == addr2, "expect the server with fewer pending calls, got %q", s)
+	for _, call := range calls {
+		<-call.Done
+	}
+}
+
+func TestXClient_Call(t *testing.T) {
+	addr1, l1 := startServer(1)
+	addr2, l2 := startServer(2)
+	defer func() { _ = l1.Close() }()
+	defer func() { _ = l2.Close() }()
+	d := NewMultiServerDiscovery([]string{addr1, addr2})
+
+	for _, mode := range []SelectMode{RandomSelect, RoundRobinSelect, WeightedRoundRobinSelect, LeastPendingSelect} {
+		xc := NewXClient(d, mode, nil)
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "mode %d: call Foo.Sum error: %v", mode, err)
+		_ = xc.Close()
+	}
+
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	seen := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		var reply int
+		_ = xc.Call(context.Background(), "Foo.Which", 0, &reply)
+		seen[reply] = true
+	}
+	_assert(seen[1] && seen[2], "round robin should reach both servers, got %v", seen)
+}
+
+func TestXClient_Broadcast(t *testing.T) {
+	addr1, l1 := startServer(1)
+	addr2, l2 := startServer(2)
+	addr3, l3 := startServer(3)
+	defer func() { _ = l1.Close() }()
+	defer func() { _ = l2.Close() }()
+	defer func() { _ = l3.Close() }()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr2, addr3}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	err := xc.Broadcast(context.Background(), "Foo.Which", 0, &reply)
+	_assert(err == nil && (reply == 2 || reply == 3), "broadcast error: %v, reply %d", err, reply)
+
+	// foo 1 fails at once and the slow call on the others should be cancelled
+	_ = xc.d.Update([]string{addr1, addr2, addr3})
+	start := time.Now()
+	err = xc.Broadcast(context.Background(), "Foo.Sleep", 2000, &reply)
+	_assert(err != nil && time.Since(start) < time.Second, "expect broadcast fail fast, got %v", err)
+
+	results, err := xc.Gather(context.Background(), "Foo.Sleep", 10, &reply)
+	_assert(err == nil && len(results) == 3, "gather error: %v", err)
+	_assert(results[0].Server == addr1 && results[0].Error != nil, "expect foo 1 failed")
+	for _, ret := range results[1:] {
+		_assert(ret.Error == nil && *ret.Reply.(*int) > 1, "expect %s succeeded, got %v", ret.Server, ret.Error)
+	}
+
+	// no servers is not a success
+	_ = xc.d.Update(nil)
+	err = xc.Broadcast(context.Background(), "Foo.Which", 0, &reply)
+	_assert(errors.Is(err, ErrNoServers), "expect ErrNoServers from broadcast, got %v", err)
+	results, err = xc.Gather(context.Background(), "Foo.Which", 0, &reply)
+	_assert(errors.Is(err, ErrNoServers) && results == nil, "expect ErrNoServers from gather, got %v", err)
+}
+
+func TestXClient_Use(t *testing.T) {
+	addr1, l1 := startServer(1)
+	addr2, l2 := startServer(2)
+	defer func() { _ = l1.Close() }()
+	defer func() { _ = l2.Close() }()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// the client dialed before Use should get the interceptor too
+	_, err := xc.dial(addr1)
+	_assert(err == nil, "dial error: %v", err)
+	var calls int32
+	xc.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		atomic.AddInt32(&calls, 1)
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+
+	var reply int
+	for i := 0; i < 2; i++ {
+		err = xc.Call(context.Background(), "Foo.Which", 0, &reply)
+		_assert(err == nil, "call error: %v", err)
+	}
+	_assert(atomic.LoadInt32(&calls) == 2, "expect 2 intercepted calls, got %d", calls)
+	_, _ = xc.Gather(context.Background(), "Foo.Which", 0, &reply)
+	_assert(atomic.LoadInt32(&calls) == 4, "expect interceptor run on every server, got %d", calls)
+}
+
+func TestXClient_Breakers(t *testing.T) {
+	addr, l := startServer(1)
+	defer func() { _ = l.Close() }()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetBreakers(client.NewBreakers(&client.BreakerOption{MinRequests: 2, ErrorRatio: 0.5, OpenTimeout: time.Minute}))
+
+	var reply int
+	for i := 0; i < 2; i++ {
+		err := xc.Call(context.Background(), "Foo.Sleep", 0, &reply)
+		_assert(err != nil && !errors.Is(err, client.ErrBreakerOpen), "expect foo 1 failed, got %v", err)
+	}
+	// foo 1 is broken, fail fast without calling it
+	err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, client.ErrBreakerOpen), "expect breaker open, got %v", err)
+}
+
+// Replica 的 Get 睡眠 delay 后返回 id，ctx 被取消时提前返回并计数
+type Replica struct {
+	id       int
+	delay    time.Duration
+	calls    int32
+	canceled int32
+}
+
+func (r *Replica) Get(ctx context.Context, args int, reply *int) error {
+	atomic.AddInt32(&r.calls, 1)
+	select {
+	case <-time.After(r.delay):
+		*reply = r.id
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt32(&r.canceled, 1)
+		return ctx.Err()
+	}
+}
+
+func (r *Replica) Put(ctx context.Context, args int, reply *int) error {
+	return r.Get(ctx, args, reply)
+}
+
+func startReplica(r *Replica) (string, net.Listener) {
+	server := rpcserver.NewServer()
+	_ = server.Register(r)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), l
+}
+
+func TestXClient_Hedging(t *testing.T) {
+	slow, fast := &Replica{id: 1, delay: time.Second}, &Replica{id: 2}
+	addr1, l1 := startReplica(slow)
+	addr2, l2 := startReplica(fast)
+	defer func() { _ = l1.Close() }()
+	defer func() { _ = l2.Close() }()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHedging(&HedgePolicy{Delay: 50 * time.Millisecond, Idempotent: []string{"Replica.Get"}})
+
+	for i := 0; i < 4; i++ {
+		var reply int
+		start := time.Now()
+		err := xc.Call(context.Background(), "Replica.Get", 0, &reply)
+		_assert(err == nil && reply == 2 && time.Since(start) < 500*time.Millisecond,
+			"expect fast replica answered in time, got %d %v after %s", reply, err, time.Since(start))
+	}
+	// half of the calls start on the slow replica and are canceled once the hedge wins
+	time.Sleep(50 * time.Millisecond)
+	_assert(atomic.LoadInt32(&slow.calls) == 2 && atomic.LoadInt32(&slow.canceled) == 2,
+		"expect slow calls canceled, got %d/%d", slow.canceled, slow.calls)
+
+	// methods not marked idempotent are never hedged
+	calls := atomic.LoadInt32(&slow.calls) + atomic.LoadInt32(&fast.calls)
+	var reply int
+	_ = xc.Call(context.Background(), "Replica.Put", 0, &reply)
+	_assert(atomic.LoadInt32(&slow.calls)+atomic.LoadInt32(&fast.calls) == calls+1, "expect Put sent once")
+}
+
+func TestLatencyWindow_P95(t *testing.T) {
+	w := &latencyWindow{}
+	for i := 1; i <= 200; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	_assert(len(w.samples) == latencyWindowSize && w.p95() == 196*time.Millisecond, "expect p95 of the last 100 samples, got %s", w.p95())
+}